@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxAttachmentBytes skips files too large to be useful as context.
+	maxAttachmentBytes = 4 << 20
+	// maxAttachmentFiles limits how many files one directory or glob adds.
+	maxAttachmentFiles = 500
+	// binarySniffBytes is how much of a file is checked for NUL bytes,
+	// the same heuristic git uses.
+	binarySniffBytes = 8000
+)
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var languageByExt = map[string]string{
+	".go": "go", ".py": "python", ".rb": "ruby", ".rs": "rust", ".js": "javascript",
+	".mjs": "javascript", ".jsx": "jsx", ".ts": "typescript", ".tsx": "tsx", ".java": "java",
+	".kt": "kotlin", ".scala": "scala", ".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp",
+	".hpp": "cpp", ".cs": "csharp", ".swift": "swift", ".php": "php", ".pl": "perl",
+	".lua": "lua", ".sh": "sh", ".bash": "bash", ".zsh": "zsh", ".fish": "fish",
+	".ps1": "powershell", ".sql": "sql", ".html": "html", ".css": "css", ".scss": "scss",
+	".json": "json", ".yaml": "yaml", ".yml": "yaml", ".toml": "toml", ".ini": "ini",
+	".xml": "xml", ".md": "markdown", ".rst": "rst", ".tf": "hcl", ".hcl": "hcl",
+	".proto": "protobuf", ".graphql": "graphql", ".vim": "vim", ".el": "elisp",
+	".ex": "elixir", ".exs": "elixir", ".erl": "erlang", ".hs": "haskell", ".ml": "ocaml",
+	".r": "r", ".jl": "julia", ".dart": "dart", ".zig": "zig", ".nix": "nix",
+	".diff": "diff", ".patch": "diff", ".mod": "go.mod", ".sum": "text", ".txt": "text",
+	".log": "text", ".csv": "csv",
+}
+
+var languageByName = map[string]string{
+	"Makefile": "makefile", "GNUmakefile": "makefile", "Dockerfile": "dockerfile",
+	"Containerfile": "dockerfile", "Jenkinsfile": "groovy", "Vagrantfile": "ruby",
+	"Gemfile": "ruby", "Rakefile": "ruby", "CMakeLists.txt": "cmake",
+	".bashrc": "bash", ".zshrc": "zsh", ".profile": "sh", ".gitignore": "gitignore",
+}
+
+// languageFor guesses a code fence language from a file name.
+func languageFor(name string) string {
+	base := filepath.Base(name)
+	if lang, ok := languageByName[base]; ok {
+		return lang
+	}
+	if strings.HasPrefix(base, "Dockerfile.") {
+		return "dockerfile"
+	}
+	return languageByExt[strings.ToLower(filepath.Ext(base))]
+}
+
+// collectAttachments expands files, directories and globs into context
+// entries. Directories and "**" globs are walked respecting .gitignore;
+// binary and oversized files are skipped with a note. A path or pattern that
+// matches nothing is an error.
+func collectAttachments(args []string) ([]ContextEntry, error) {
+	var entries []ContextEntry
+	seen := map[string]bool{}
+	for _, arg := range args {
+		files, err := expandAttachment(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			abs, err := filepath.Abs(file)
+			if err != nil {
+				abs = file
+			}
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			entry, skip, err := readAttachment(file)
+			if err != nil {
+				return nil, err
+			}
+			if skip != "" {
+				fmt.Fprintf(os.Stderr, "Skipping %s (%s)\n", file, skip)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// attachmentSummary describes attached files for a one-line confirmation.
+func attachmentSummary(entries []ContextEntry) string {
+	tokens := 0
+	for _, e := range entries {
+		tokens += countTokens(e.Content)
+	}
+	if len(entries) == 1 {
+		return fmt.Sprintf("Attached %s (%d tokens)", entries[0].Source, tokens)
+	}
+	return fmt.Sprintf("Attached %d files (%d tokens)", len(entries), tokens)
+}
+
+func expandAttachment(arg string) ([]string, error) {
+	if strings.ContainsAny(arg, "*?[") {
+		files, err := globAttachment(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no files match %s", arg)
+		}
+		return files, nil
+	}
+	fi, err := os.Stat(arg)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		files, err := walkAttachmentDir(arg, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no files to attach in %s", arg)
+		}
+		return files, nil
+	}
+	return []string{arg}, nil
+}
+
+// globAttachment expands a glob. Patterns with "**" match any number of
+// directories and are resolved by walking the fixed part of the pattern.
+func globAttachment(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, m := range matches {
+			fi, err := os.Stat(m)
+			if err != nil {
+				continue
+			}
+			if fi.IsDir() {
+				sub, err := walkAttachmentDir(m, nil)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, sub...)
+				continue
+			}
+			files = append(files, m)
+		}
+		return files, nil
+	}
+
+	segs := strings.Split(filepath.ToSlash(pattern), "/")
+	fixed := 0
+	for fixed < len(segs) && !strings.ContainsAny(segs[fixed], "*?[") {
+		fixed++
+	}
+	root := strings.Join(segs[:fixed], "/")
+	if root == "" {
+		root = "."
+		if strings.HasPrefix(pattern, "/") {
+			root = "/"
+		}
+	}
+	rest := segs[fixed:]
+	return walkAttachmentDir(filepath.FromSlash(root), func(rel string) bool {
+		return matchSegments(rest, strings.Split(rel, "/"))
+	})
+}
+
+// walkAttachmentDir lists the files under root that git wouldn't ignore,
+// keeping those accepted by match (given the slash-separated path relative
+// to root), or all of them if match is nil.
+func walkAttachmentDir(root string, match func(rel string) bool) ([]string, error) {
+	ignore, err := newGitignore(root)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil // unreadable entries are skipped
+		}
+		if p == root {
+			if d.IsDir() {
+				ignore.load(p)
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || ignore.ignored(p, true) {
+				return filepath.SkipDir
+			}
+			ignore.load(p)
+			return nil
+		}
+		if !d.Type().IsRegular() || ignore.ignored(p, false) {
+			return nil
+		}
+		if match != nil {
+			rel, err := filepath.Rel(root, p)
+			if err != nil || !match(filepath.ToSlash(rel)) {
+				return nil
+			}
+		}
+		if len(files) >= maxAttachmentFiles {
+			return errAttachmentLimit
+		}
+		files = append(files, p)
+		return nil
+	})
+	if errors.Is(err, errAttachmentLimit) {
+		fmt.Fprintf(os.Stderr, "Warning: only the first %d files under %s were attached.\n", maxAttachmentFiles, root)
+		err = nil
+	}
+	return files, err
+}
+
+var errAttachmentLimit = errors.New("too many files")
+
+// readAttachment loads a file as a context entry. skip explains why a file
+// was left out (binary, too large) and is empty otherwise.
+func readAttachment(file string) (entry ContextEntry, skip string, err error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return entry, "", err
+	}
+	if fi.Size() > maxAttachmentBytes {
+		return entry, fmt.Sprintf("larger than %d MiB", maxAttachmentBytes>>20), nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return entry, "", err
+	}
+	sniff := data
+	if len(sniff) > binarySniffBytes {
+		sniff = sniff[:binarySniffBytes]
+	}
+	if bytes.IndexByte(sniff, 0) >= 0 || !utf8.Valid(data) {
+		return entry, "binary", nil
+	}
+
+	source := file
+	if rel, err := filepath.Rel(".", file); err == nil && !strings.HasPrefix(rel, "..") {
+		source = rel
+	}
+	return ContextEntry{
+		Kind:     "file",
+		Source:   source,
+		Language: languageFor(file),
+		Content:  strings.TrimRight(string(data), "\n"),
+		Time:     time.Now(),
+	}, "", nil
+}
+
+// gitignore holds the ignore rules seen while walking a tree. Rules apply
+// to paths below the directory of the .gitignore they came from.
+type gitignore struct {
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	base     string   // absolute directory of the .gitignore
+	segments []string // pattern split on "/"
+	negate   bool     // "!pattern" re-includes a path
+	dirOnly  bool     // "pattern/" only matches directories
+	anchored bool     // the pattern contains a "/" and matches from base
+}
+
+// newGitignore starts with the .gitignore files between the enclosing git
+// repository's root and root itself, so attaching a subdirectory honours
+// the rules above it.
+func newGitignore(root string) (*gitignore, error) {
+	g := &gitignore{}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(abs, ".git")); err == nil {
+		return g, nil // root is the top of a repository
+	}
+	var parents []string
+	found := false
+	for dir := filepath.Dir(abs); ; {
+		parents = append([]string{dir}, parents...)
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			found = true
+			break
+		}
+		next := filepath.Dir(dir)
+		if next == dir {
+			break
+		}
+		dir = next
+	}
+	if !found {
+		return g, nil // not inside a repository
+	}
+	for _, dir := range parents {
+		g.load(dir)
+	}
+	return g, nil
+}
+
+// load reads dir/.gitignore if there is one.
+func (g *gitignore) load(dir string) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	f, err := os.Open(filepath.Join(abs, ".gitignore"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: abs}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.segments = strings.Split(line, "/")
+		g.rules = append(g.rules, rule)
+	}
+}
+
+// ignored reports whether p is ignored. As in git, the last matching rule
+// wins.
+func (g *gitignore) ignored(p string, isDir bool) bool {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	ignored := false
+	for _, r := range g.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		rel, err := filepath.Rel(r.base, abs)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		segs := strings.Split(filepath.ToSlash(rel), "/")
+		var matched bool
+		if r.anchored {
+			matched = matchSegments(r.segments, segs)
+		} else {
+			matched, _ = path.Match(r.segments[0], segs[len(segs)-1])
+		}
+		if matched {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches path segments against pattern segments, where "**"
+// matches any number of segments.
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
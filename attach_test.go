@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeTree creates files (with "/" separated paths) under root. A path
+// ending in "/" is an empty directory.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// walkedFiles returns the files walkAttachmentDir keeps under dir, relative
+// to root and sorted.
+func walkedFiles(t *testing.T, root, dir string) []string {
+	t.Helper()
+	files, err := walkAttachmentDir(filepath.Join(root, filepath.FromSlash(dir)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rel []string
+	for _, f := range files {
+		r, err := filepath.Rel(root, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	sort.Strings(rel)
+	return rel
+}
+
+func TestGitignore(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".git/": "",
+		".gitignore": strings.Join([]string{
+			"# build output",
+			"*.log",
+			"!keep.log",
+			"/build",
+			"docs/*.tmp",
+			"**/cache/",
+			"out/",
+			"logs/**",
+			`\#hash`,
+			`\!bang`,
+			"vendor/**/gen.go",
+			"trailing.txt   ",
+		}, "\n"),
+		"a.go":              "",
+		"x.log":             "",
+		"keep.log":          "",
+		"#hash":             "",
+		"!bang":             "",
+		"bang":              "",
+		"a.gen":             "",
+		"local":             "",
+		"cache":             "a file, not a directory",
+		"out.go":            "",
+		"trailing.txt":      "",
+		"build/b.go":        "",
+		"src/build/c.go":    "",
+		"docs/n.tmp":        "",
+		"docs/readme.md":    "",
+		"docs/sub/m.tmp":    "",
+		"x/cache/y.go":      "",
+		"cache2/z.go":       "",
+		"src/out/z.go":      "",
+		"logs/a/b.txt":      "",
+		"vendor/gen.go":     "",
+		"vendor/p/q/gen.go": "",
+		"vendor/p/other.go": "",
+
+		// A nested .gitignore only applies below its directory, and can
+		// re-include what a parent excluded.
+		"src/.gitignore":    "*.gen\n!important.log\n/local\n",
+		"src/a.gen":         "",
+		"src/important.log": "",
+		"src/other.log":     "",
+		"src/local":         "",
+		"src/sub/local":     "",
+		"src/sub/deep.gen":  "",
+	})
+
+	want := []string{
+		".gitignore",
+		"a.gen",
+		"a.go",
+		"bang",
+		"cache",
+		"cache2/z.go",
+		"docs/readme.md",
+		"docs/sub/m.tmp",
+		"keep.log",
+		"local",
+		"out.go",
+		"src/.gitignore",
+		"src/build/c.go",
+		"src/important.log",
+		"src/sub/local",
+		"vendor/p/other.go",
+	}
+	if got := walkedFiles(t, root, "."); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("walking the repository kept\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Walking a subdirectory still honours the .gitignore files above it.
+	want = []string{"src/.gitignore", "src/build/c.go", "src/important.log", "src/sub/local"}
+	if got := walkedFiles(t, root, "src"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("walking src kept\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestGitignoreLastRuleWins(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		".git/":      "",
+		".gitignore": "*.txt\n!*.txt\nb.txt\n",
+		"a.txt":      "",
+		"b.txt":      "",
+	})
+	g, err := newGitignore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.load(root)
+	for name, want := range map[string]bool{"a.txt": false, "b.txt": true, "c.go": false} {
+		if got := g.ignored(filepath.Join(root, name), false); got != want {
+			t.Errorf("ignored(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"**/b", "b", true},
+		{"**/b", "a/x/b", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "c/a/b", false},
+		{"a/**", "a/x/y", true},
+		{"**", "a/b/c", true},
+		{"*.go", "a/b.go", false},
+	}
+	for _, tt := range tests {
+		if got := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.path, "/")); got != tt.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.want)
+		}
+	}
+}
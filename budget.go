@@ -0,0 +1,519 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Trim policies decide how context is shortened when a prompt is over budget.
+const (
+	trimOldest   = "oldest"   // drop the oldest context first, keeping the newest output
+	trimHeadTail = "headtail" // shrink every entry, keeping its beginning and end
+	trimErrors   = "errors"   // keep lines that look like errors, then head and tail
+)
+
+var trimPolicies = []string{trimOldest, trimHeadTail, trimErrors}
+
+// minItemTokens is the smallest share worth keeping of a context entry;
+// anything less is dropped instead.
+const minItemTokens = 16
+
+var (
+	trimPolicy    = trimHeadTail
+	errorPatterns []string // from the config; defaultErrorPatterns if empty
+
+	compiledErrorPatternsOnce sync.Once
+	compiledErrorPatterns     []*regexp.Regexp
+)
+
+var defaultErrorPatterns = []string{
+	`(?i)\berror\b`,
+	`(?i)\bfail(ed|ure|s)?\b`,
+	`(?i)\bfatal\b`,
+	`(?i)\bpanic\b`,
+	`(?i)exception`,
+	`(?i)traceback`,
+	`(?i)\bwarning\b`,
+	`(?i)permission denied`,
+	`(?i)no such file`,
+	`(?i)not found`,
+	`\.\w+:\d+(:\d+)?`, // file.go:12:3 style locations
+}
+
+func validTrimPolicy(p string) bool {
+	for _, known := range trimPolicies {
+		if p == known {
+			return true
+		}
+	}
+	return false
+}
+
+func setTrimPolicy(p string) {
+	if p == "" {
+		return
+	}
+	if !validTrimPolicy(p) {
+		fmt.Fprintf(os.Stderr, "Unknown trim policy %q (available: %s)\n", p, strings.Join(trimPolicies, ", "))
+		os.Exit(1)
+	}
+	trimPolicy = p
+}
+
+// contextItem is an optional part of a prompt, such as a context command's
+// output. Items share whatever the question leaves of the budget.
+// Only Body is ever shortened, so the header naming the source survives.
+type contextItem struct {
+	Label  string // shown in the trim report
+	Header string
+	Body   string
+	Footer string
+}
+
+func (c contextItem) Text() string {
+	return c.Header + c.Body + c.Footer
+}
+
+// trimBody shortens the item's body with cut so the whole item fits in max
+// tokens, or returns "" if there is no useful room left for the body.
+func (c contextItem) trimBody(max int, cut func(body string, max int) string) string {
+	room := max - countTokens(c.Header+c.Footer)
+	if room < minItemTokens {
+		return ""
+	}
+	return c.Header + cut(c.Body, room) + c.Footer
+}
+
+type trimAction struct {
+	Label string
+	From  int // tokens before trimming
+	To    int // tokens after; 0 if the item was dropped
+	How   string
+}
+
+// budgetReport records what was cut to make a prompt fit.
+type budgetReport struct {
+	Budget  int
+	Policy  string
+	Actions []trimAction
+}
+
+func (r budgetReport) Trimmed() bool {
+	return len(r.Actions) > 0
+}
+
+// setAction records a, replacing an earlier action on the same item.
+func (r *budgetReport) setAction(a trimAction) {
+	for i := range r.Actions {
+		if r.Actions[i].Label == a.Label {
+			r.Actions[i] = a
+			return
+		}
+	}
+	r.Actions = append(r.Actions, a)
+}
+
+func (r budgetReport) Print(w io.Writer) {
+	if !r.Trimmed() {
+		return
+	}
+	fmt.Fprintf(w, "Prompt trimmed to fit the %d-token budget (policy: %s):\n", r.Budget, r.Policy)
+	for _, a := range r.Actions {
+		if a.To == 0 {
+			fmt.Fprintf(w, "  dropped  %s (%d tokens)\n", a.Label, a.From)
+		} else {
+			fmt.Fprintf(w, "  trimmed  %s (%d -> %d tokens, %s)\n", a.Label, a.From, a.To, a.How)
+		}
+	}
+}
+
+// budgetTurn builds a user turn that fits in what the prompt budget leaves
+// after history. The question is mandatory: context items are trimmed by the
+// current policy first, and the question is only shortened if it cannot fit
+// on its own. layout assembles the turn from the question and the kept item
+// texts, which line up with items ("" for dropped ones).
+func budgetTurn(history []openai.ChatCompletionMessage, question string, items []contextItem, layout func(question string, kept []string) string) (string, []string, budgetReport) {
+	report := budgetReport{Budget: promptBudget(), Policy: trimPolicy}
+	room := report.Budget - tokensPerMessage
+	if len(history) > 0 {
+		room -= countMessageTokens(history)
+	} else {
+		room -= tokensPerReply
+	}
+
+	texts := make([]string, len(items))
+	tokens := make([]int, len(items))
+	sum := 0
+	for i, item := range items {
+		texts[i] = item.Text()
+		tokens[i] = countTokens(texts[i])
+		sum += tokens[i]
+	}
+	// Headers and separators the layout adds around the context.
+	overhead := countTokens(layout("", texts)) - sum
+	if overhead < 0 {
+		overhead = 0
+	}
+
+	if turn := layout(question, texts); countTokens(turn) <= room {
+		return turn, texts, report
+	}
+	questionTokens := countTokens(question)
+
+	available := room - questionTokens - overhead
+	if available < minItemTokens {
+		// No room for any context; keep as much of the question as fits.
+		for i := range items {
+			if tokens[i] > 0 {
+				report.Actions = append(report.Actions, trimAction{Label: items[i].Label, From: tokens[i]})
+			}
+			texts[i] = ""
+		}
+		if questionTokens+overhead > room {
+			question = headTail(question, room-overhead)
+			report.Actions = append(report.Actions, trimAction{Label: "question", From: questionTokens, To: countTokens(question), How: "head and tail kept"})
+		}
+	} else {
+		var actions []trimAction
+		switch trimPolicy {
+		case trimOldest:
+			texts, actions = trimOldestFirst(items, tokens, available)
+		default:
+			texts, actions = trimShares(items, tokens, available, trimPolicy)
+		}
+		report.Actions = actions
+	}
+
+	turn := layout(question, texts)
+	// Token counts of the pieces don't add up exactly once joined. Cut the
+	// small remainder from the largest kept item, so the question stays
+	// whole, and only shorten the question once no context is left.
+	for n := countTokens(turn); n > room; n = countTokens(turn) {
+		if debugMode {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Budgeted turn is %d tokens, %d over; trimming\n", n, n-room)
+		}
+		i := largestText(texts)
+		if i < 0 {
+			question = headTail(question, countTokens(question)-(n-room))
+			report.setAction(trimAction{Label: "question", From: questionTokens, To: countTokens(question), How: "head and tail kept"})
+			turn = layout(question, texts)
+			if countTokens(turn) > room {
+				turn = truncateToTokens(turn, room)
+			}
+			break
+		}
+		cut, how := headTail, "head and tail kept"
+		if trimPolicy == trimOldest {
+			cut, how = keepTail, "tail kept"
+		}
+		kept := countTokens(texts[i])
+		texts[i] = items[i].trimBody(kept-(n-room)-1, cut)
+		if texts[i] != "" && countTokens(texts[i]) >= kept {
+			texts[i] = ""
+		}
+		if texts[i] == "" {
+			report.setAction(trimAction{Label: items[i].Label, From: tokens[i]})
+		} else {
+			report.setAction(trimAction{Label: items[i].Label, From: tokens[i], To: countTokens(texts[i]), How: how})
+		}
+		turn = layout(question, texts)
+	}
+	return turn, texts, report
+}
+
+// largestText returns the index of the longest non-empty text, or -1.
+func largestText(texts []string) int {
+	best := -1
+	for i, t := range texts {
+		if t != "" && (best < 0 || len(t) > len(texts[best])) {
+			best = i
+		}
+	}
+	return best
+}
+
+// trimOldestFirst drops items from the front until the rest fits. The item
+// that straddles the limit keeps its most recent output.
+func trimOldestFirst(items []contextItem, tokens []int, available int) ([]string, []trimAction) {
+	texts := make([]string, len(items))
+	total := 0
+	for i := range items {
+		texts[i] = items[i].Text()
+		total += tokens[i]
+	}
+	var actions []trimAction
+	for i := range items {
+		if total <= available {
+			break
+		}
+		excess := total - available
+		texts[i] = items[i].trimBody(tokens[i]-excess, keepTail)
+		if texts[i] == "" {
+			total -= tokens[i]
+			actions = append(actions, trimAction{Label: items[i].Label, From: tokens[i]})
+			continue
+		}
+		total = available
+		actions = append(actions, trimAction{Label: items[i].Label, From: tokens[i], To: countTokens(texts[i]), How: "tail kept"})
+	}
+	return texts, actions
+}
+
+// trimShares splits the available tokens fairly: items smaller than their
+// share stay whole and the rest is divided among the larger ones.
+func trimShares(items []contextItem, tokens []int, available int, policy string) ([]string, []trimAction) {
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return tokens[order[a]] < tokens[order[b]] })
+
+	shares := make([]int, len(items))
+	left := available
+	for k, i := range order {
+		share := left / (len(order) - k)
+		if tokens[i] <= share {
+			share = tokens[i]
+		}
+		shares[i] = share
+		left -= share
+	}
+
+	texts := make([]string, len(items))
+	var actions []trimAction
+	for i, item := range items {
+		if tokens[i] <= shares[i] {
+			texts[i] = item.Text()
+			continue
+		}
+		how := "head and tail kept"
+		cut := headTail
+		if policy == trimErrors {
+			cut = func(body string, max int) string {
+				var text string
+				text, how = keepErrorLines(body, max)
+				return text
+			}
+		}
+		texts[i] = item.trimBody(shares[i], cut)
+		if texts[i] == "" {
+			actions = append(actions, trimAction{Label: item.Label, From: tokens[i]})
+			continue
+		}
+		actions = append(actions, trimAction{Label: item.Label, From: tokens[i], To: countTokens(texts[i]), How: how})
+	}
+	return texts, actions
+}
+
+// omittedMarker notes how much was cut from the middle of a text.
+func omittedMarker(tokens int) string {
+	return fmt.Sprintf("[... %d tokens omitted ...]", tokens)
+}
+
+// headTail keeps the beginning and end of text within max tokens, preferring
+// the end (where errors and summaries usually are) and cutting on line
+// boundaries where possible.
+func headTail(text string, max int) string {
+	total := countTokens(text)
+	if total <= max {
+		return text
+	}
+	room := max - countTokens(omittedMarker(total)) - 2
+	if room <= 0 {
+		return truncateToTokens(text, max)
+	}
+	// Work with offsets into text, so head, middle and tail always add up
+	// to it.
+	cut := prefixTokens(text, room/3)
+	if i := strings.LastIndex(text[:cut], "\n"); i > 0 {
+		cut = i + 1
+	}
+	head, rest := text[:cut], text[cut:]
+	start := suffixTokens(rest, room-countTokens(head))
+	if i := strings.Index(rest[start:], "\n"); i >= 0 && start+i < len(rest)-1 {
+		start += i + 1
+	}
+	return head + "\n" + omittedMarker(countTokens(rest[:start])) + "\n" + rest[start:]
+}
+
+// keepTail keeps the end of text within max tokens, starting on a line
+// boundary where possible.
+func keepTail(text string, max int) string {
+	total := countTokens(text)
+	if total <= max {
+		return text
+	}
+	room := max - countTokens(omittedMarker(total)) - 1
+	if room <= 0 {
+		return ""
+	}
+	start := suffixTokens(text, room)
+	if i := strings.Index(text[start:], "\n"); i >= 0 && start+i < len(text)-1 {
+		start += i + 1
+	}
+	return omittedMarker(countTokens(text[:start])) + "\n" + text[start:]
+}
+
+// errorContextLines is how many lines around an error line are kept.
+const errorContextLines = 2
+
+// keepErrorLines keeps the lines of text that match the error patterns, with
+// a little surrounding context and the first and last lines, within max
+// tokens. Without any matches it falls back to head and tail.
+func keepErrorLines(text string, max int) (string, string) {
+	patterns := getErrorPatterns()
+	lines := strings.Split(text, "\n")
+	keep := make([]bool, len(lines))
+	matched := 0
+	for i, line := range lines {
+		for _, re := range patterns {
+			if re.MatchString(line) {
+				matched++
+				for j := i - errorContextLines; j <= i+errorContextLines; j++ {
+					if j >= 0 && j < len(lines) {
+						keep[j] = true
+					}
+				}
+				break
+			}
+		}
+	}
+	if matched == 0 {
+		return headTail(text, max), "no error lines, head and tail kept"
+	}
+	for i := 0; i < len(lines) && i < 3; i++ {
+		keep[i] = true
+	}
+	for i := len(lines) - 5; i < len(lines); i++ {
+		if i >= 0 {
+			keep[i] = true
+		}
+	}
+
+	var b strings.Builder
+	var skipped []string
+	flush := func() {
+		if len(skipped) > 0 {
+			b.WriteString(omittedMarker(countTokens(strings.Join(skipped, "\n"))) + "\n")
+			skipped = nil
+		}
+	}
+	for i, line := range lines {
+		if !keep[i] {
+			skipped = append(skipped, line)
+			continue
+		}
+		flush()
+		b.WriteString(line)
+		if i < len(lines)-1 {
+			b.WriteString("\n")
+		}
+	}
+	flush()
+
+	how := fmt.Sprintf("%d matching lines kept", matched)
+	result := b.String()
+	if countTokens(result) > max {
+		result = headTail(result, max)
+		how += ", then head and tail"
+	}
+	return result, how
+}
+
+func getErrorPatterns() []*regexp.Regexp {
+	compiledErrorPatternsOnce.Do(func() {
+		patterns := errorPatterns
+		if len(patterns) == 0 {
+			patterns = defaultErrorPatterns
+		}
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: ignoring invalid error pattern %q: %v\n", p, err)
+				continue
+			}
+			compiledErrorPatterns = append(compiledErrorPatterns, re)
+		}
+	})
+	return compiledErrorPatterns
+}
+
+// contextItems turns context entries into budget items.
+func contextItems(entries []ContextEntry) []contextItem {
+	var items []contextItem
+	for _, e := range entries {
+		label := "context"
+		switch e.Kind {
+		case "command":
+			label = "context `" + e.Source + "`"
+		case "file":
+			label = "file " + e.Source
+		case "stdin":
+			label = "stdin"
+		}
+		items = append(items, contextItem{Label: label, Header: e.header(), Body: e.Content, Footer: e.footer()})
+	}
+	return items
+}
+
+// runItems turns recorded runs into budget items: one for stdout, headed
+// by the command and how it ended, and one for stderr if there was any, so
+// each can be trimmed on its own.
+func runItems(runs []SessionRun) []contextItem {
+	var items []contextItem
+	for _, r := range runs {
+		item := contextItem{Label: "run output", Header: "\n---\n", Body: r.Output, Footer: "\n"}
+		if r.Command != "" {
+			item.Label = "run output `" + r.Command + "`"
+			if r.Check {
+				item.Header += "Check: " + r.Command + "\n"
+			} else {
+				item.Header += "Command: " + r.Command + "\n"
+			}
+		}
+		if status := r.Status(); status != "" {
+			item.Header += "Result: " + status + "\n"
+		} else if r.Error != "" {
+			item.Footer += "Error: " + r.Error + "\n"
+		}
+		if r.PTY {
+			item.Header += "Terminal transcript:\n"
+		}
+		if r.Stderr == "" {
+			item.Footer += r.sandboxNote()
+			items = append(items, item)
+			continue
+		}
+		if r.Output != "" {
+			item.Header += "Stdout:\n"
+		}
+		errItem := contextItem{Label: strings.Replace(item.Label, "output", "stderr", 1), Header: "Stderr:\n", Body: r.Stderr, Footer: "\n" + r.sandboxNote()}
+		items = append(items, item, errItem)
+	}
+	return items
+}
+
+// markTrimmed records on entries which ones were cut or dropped, given the
+// kept texts budgetTurn returned for them.
+func markTrimmed(entries []ContextEntry, kept []string) {
+	for i := range entries {
+		if i >= len(kept) {
+			break
+		}
+		full := entries[i].Format()
+		switch {
+		case full == "":
+		case kept[i] == "":
+			entries[i].Trimmed = trimmedDropped
+		case kept[i] != full:
+			entries[i].Trimmed = trimmedPartial
+		}
+	}
+}
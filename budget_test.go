@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// useBudget selects a model with a known tokenizer and caps the prompt at
+// budget tokens for the rest of the test.
+func useBudget(t *testing.T, budget int, policy string) {
+	t.Helper()
+	savedModel, savedMax, savedPolicy := model, maxTokens, trimPolicy
+	t.Cleanup(func() { model, maxTokens, trimPolicy = savedModel, savedMax, savedPolicy })
+	model, maxTokens, trimPolicy = "gpt-4", budget, policy
+}
+
+// numberedLines returns n lines of log output; every tenth is an error.
+func numberedLines(prefix string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		if i%10 == 7 {
+			fmt.Fprintf(&b, "%s line %d: error: disk quota exceeded\n", prefix, i)
+		} else {
+			fmt.Fprintf(&b, "%s line %d: copying file number %d into place\n", prefix, i, i)
+		}
+	}
+	return b.String()
+}
+
+var omittedRE = regexp.MustCompile(`\n?\[\.\.\. (\d+) tokens omitted \.\.\.\]\n`)
+
+// checkCut checks that cut text keeps a prefix and a suffix of text, and
+// that its marker counts what is missing between them.
+func checkCut(t *testing.T, name, text, cut string, max int) {
+	t.Helper()
+	if n := countTokens(cut); n > max {
+		t.Errorf("%s: %d tokens, want at most %d", name, n, max)
+	}
+	loc := omittedRE.FindStringSubmatchIndex(cut)
+	if loc == nil {
+		t.Fatalf("%s: no omitted marker in %q", name, cut)
+	}
+	head, tail := cut[:loc[0]], cut[loc[1]:]
+	if !strings.HasPrefix(text, head) {
+		t.Errorf("%s: head %q is not a prefix of the text", name, head)
+	}
+	if !strings.HasSuffix(text, tail) {
+		t.Errorf("%s: tail %q is not a suffix of the text", name, tail)
+	}
+	if len(head)+len(tail) > len(text) {
+		t.Fatalf("%s: head and tail overlap", name)
+	}
+	middle := text[len(head) : len(text)-len(tail)]
+	if got, _ := strconv.Atoi(cut[loc[2]:loc[3]]); got != countTokens(middle) {
+		t.Errorf("%s: marker says %d tokens omitted, the middle has %d", name, got, countTokens(middle))
+	}
+}
+
+func TestTruncateAndTailTokens(t *testing.T) {
+	useBudget(t, 0, trimHeadTail)
+	// Emoji and CJK split across tokens, and invalid bytes that a decoder
+	// would replace or drop.
+	text := strings.Repeat("héllo 世界 🙂🙃 \xff\xfe ok ", 50)
+	for max := 1; max < 60; max += 7 {
+		if head := truncateToTokens(text, max); !strings.HasPrefix(text, head) || countTokens(head) > max {
+			t.Errorf("truncateToTokens(%d) = %q, not a prefix within budget", max, head)
+		}
+		if tail := tailTokens(text, max); !strings.HasSuffix(text, tail) || countTokens(tail) > max {
+			t.Errorf("tailTokens(%d) = %q, not a suffix within budget", max, tail)
+		}
+	}
+	if got := truncateToTokens(text, 0); got != "" {
+		t.Errorf("truncateToTokens(0) = %q", got)
+	}
+	if got := tailTokens("short", 100); got != "short" {
+		t.Errorf("tailTokens kept %q of a short text", got)
+	}
+}
+
+func TestHeadTail(t *testing.T) {
+	useBudget(t, 0, trimHeadTail)
+	text := numberedLines("build", 200)
+	if got := headTail(text, countTokens(text)); got != text {
+		t.Error("headTail changed a text that fits exactly")
+	}
+	for _, max := range []int{40, 100, 500, countTokens(text) - 1} {
+		checkCut(t, fmt.Sprintf("headTail(%d)", max), text, headTail(text, max), max)
+	}
+	// Invalid UTF-8 must not shift the cut.
+	binary := strings.Repeat("\xff\xfe data \x80 line\n", 200)
+	checkCut(t, "headTail(binary)", binary, headTail(binary, 60), 60)
+	if got := headTail(text, 5); countTokens(got) > 5 || !strings.HasPrefix(text, got) {
+		t.Errorf("headTail with no room for the marker = %q, want a prefix", got)
+	}
+}
+
+func TestKeepTail(t *testing.T) {
+	useBudget(t, 0, trimOldest)
+	text := numberedLines("test", 200)
+	if got := keepTail(text, countTokens(text)); got != text {
+		t.Error("keepTail changed a text that fits exactly")
+	}
+	for _, max := range []int{30, 300, countTokens(text) - 1} {
+		got := keepTail(text, max)
+		checkCut(t, fmt.Sprintf("keepTail(%d)", max), text, got, max)
+		if !strings.HasPrefix(got, "[...") {
+			t.Errorf("keepTail(%d) kept the head: %q", max, got[:40])
+		}
+	}
+	if got := keepTail(text, 5); got != "" {
+		t.Errorf("keepTail with no room for the marker = %q, want nothing", got)
+	}
+}
+
+func TestKeepErrorLines(t *testing.T) {
+	useBudget(t, 0, trimErrors)
+	text := numberedLines("job", 300)
+	got, how := keepErrorLines(text, 600)
+	if countTokens(got) > 600 {
+		t.Errorf("kept %d tokens, want at most 600", countTokens(got))
+	}
+	if !strings.Contains(how, "30 matching lines") {
+		t.Errorf("how = %q, want 30 matching lines", how)
+	}
+	for _, want := range []string{"job line 0:", "job line 297: error", "job line 299:"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q was not kept", want)
+		}
+	}
+	if strings.Contains(got, "job line 100:") {
+		t.Error("a line far from any error was kept")
+	}
+
+	got, how = keepErrorLines(text, 100)
+	if countTokens(got) > 100 || !strings.Contains(how, "then head and tail") {
+		t.Errorf("over budget after keeping errors: %d tokens, %q", countTokens(got), how)
+	}
+
+	quiet := strings.Repeat("all good here\n", 300)
+	got, how = keepErrorLines(quiet, 50)
+	checkCut(t, "keepErrorLines(no errors)", quiet, got, 50)
+	if !strings.Contains(how, "no error lines") {
+		t.Errorf("how = %q", how)
+	}
+}
+
+func testLayout(question string, kept []string) string {
+	return strings.Join(kept, "") + "\nQuestion: " + question
+}
+
+func testItems() []contextItem {
+	return []contextItem{
+		{Label: "old", Header: "\n--- old\n", Body: numberedLines("old", 150), Footer: "\n"},
+		{Label: "small", Header: "\n--- small\n", Body: "exit status 1\n", Footer: "\n"},
+		{Label: "new", Header: "\n--- new\n", Body: numberedLines("new", 150), Footer: "\n"},
+	}
+}
+
+func TestBudgetTurnFitsExactly(t *testing.T) {
+	question := "Why did the build fail?"
+	items := testItems()
+	var texts []string
+	for _, item := range items {
+		texts = append(texts, item.Text())
+	}
+	useBudget(t, 0, trimHeadTail)
+	full := testLayout(question, texts)
+	exact := countTokens(full) + tokensPerMessage + tokensPerReply
+
+	for _, policy := range trimPolicies {
+		useBudget(t, exact, policy)
+		turn, _, report := budgetTurn(nil, question, items, testLayout)
+		if turn != full || report.Trimmed() {
+			t.Errorf("%s: a turn that fits exactly was trimmed: %+v", policy, report.Actions)
+		}
+
+		useBudget(t, exact-1, policy)
+		turn, _, report = budgetTurn(nil, question, items, testLayout)
+		if !report.Trimmed() {
+			t.Errorf("%s: a turn one token over was not trimmed", policy)
+		}
+		if n := countTokens(turn); n > exact-1-tokensPerMessage-tokensPerReply {
+			t.Errorf("%s: one token over: turn is %d tokens, over the budget", policy, n)
+		}
+		if !strings.HasSuffix(turn, "Question: "+question) {
+			t.Errorf("%s: the question was not kept whole", policy)
+		}
+	}
+}
+
+func TestBudgetTurnPolicies(t *testing.T) {
+	question := "Why did the build fail?"
+	for _, policy := range trimPolicies {
+		for _, budget := range []int{300, 800, 1500} {
+			useBudget(t, budget, policy)
+			turn, kept, report := budgetTurn(nil, question, testItems(), testLayout)
+			room := budget - tokensPerMessage - tokensPerReply
+			name := fmt.Sprintf("%s/%d", policy, budget)
+			if n := countTokens(turn); n > room {
+				t.Errorf("%s: turn is %d tokens, room is %d", name, n, room)
+			}
+			if !strings.HasSuffix(turn, "Question: "+question) {
+				t.Errorf("%s: the question was not kept whole", name)
+			}
+			if !report.Trimmed() || report.Policy != policy {
+				t.Errorf("%s: report %+v", name, report)
+			}
+			if len(kept) != 3 {
+				t.Fatalf("%s: %d kept texts, want 3", name, len(kept))
+			}
+			for i, text := range kept {
+				if text != "" && !strings.HasPrefix(text, testItems()[i].Header) {
+					t.Errorf("%s: item %d lost its header: %q", name, i, text[:20])
+				}
+			}
+			switch policy {
+			case trimOldest:
+				// The newest output is kept before anything older.
+				if kept[2] == "" || strings.Contains(kept[2], "new line 0:") && kept[0] == "" {
+					t.Errorf("%s: the newest item was cut first", name)
+				}
+				if !strings.Contains(kept[2], "new line 149:") {
+					t.Errorf("%s: the end of the newest item was not kept", name)
+				}
+			case trimHeadTail:
+				if kept[1] != testItems()[1].Text() {
+					t.Errorf("%s: the small item was cut: %q", name, kept[1])
+				}
+			case trimErrors:
+				if budget >= 800 && !strings.Contains(kept[2], "error: disk quota exceeded") {
+					t.Errorf("%s: no error lines kept", name)
+				}
+			}
+		}
+	}
+}
+
+func TestBudgetTurnQuestionTooLong(t *testing.T) {
+	question := numberedLines("question", 100)
+	for _, policy := range trimPolicies {
+		useBudget(t, 200, policy)
+		turn, kept, report := budgetTurn(nil, question, testItems(), testLayout)
+		if n := countTokens(turn); n > 200-tokensPerMessage-tokensPerReply {
+			t.Errorf("%s: turn is %d tokens", policy, n)
+		}
+		for i, text := range kept {
+			if text != "" {
+				t.Errorf("%s: item %d was kept although the question doesn't fit", policy, i)
+			}
+		}
+		var questionCut bool
+		for _, a := range report.Actions {
+			questionCut = questionCut || a.Label == "question" && a.To > 0
+		}
+		if !questionCut {
+			t.Errorf("%s: no question action in %+v", policy, report.Actions)
+		}
+		if !strings.Contains(turn, "question line 0:") || !strings.Contains(turn, "question line 99:") {
+			t.Errorf("%s: the head and tail of the question were not kept", policy)
+		}
+	}
+}
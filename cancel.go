@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"time"
+)
+
+// Timeouts for API calls and shell commands (runs and context commands).
+// Zero means no limit.
+var (
+	apiTimeout     = 5 * time.Minute
+	commandTimeout = 10 * time.Minute
+)
+
+// Errors for operations cancelled with Ctrl+C or cut off by a timeout.
+var (
+	errInterrupted = errors.New("interrupted")
+	errTimedOut    = errors.New("timed out")
+)
+
+// commandWaitDelay is how long a cancelled command's output is still read
+// after it was killed.
+const commandWaitDelay = 2 * time.Second
+
+// parseTimeout parses a timeout such as "30s" or "5m"; "0" means no limit.
+func parseTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timeout %q: use a duration like 30s or 5m, or 0 for no limit", value)
+	}
+	return d, nil
+}
+
+// configTimeout sets *d from a config value. Invalid values are ignored
+// with a warning, so that a typo doesn't lock the user out of every command.
+func configTimeout(d *time.Duration, value, key string) {
+	if value == "" {
+		return
+	}
+	parsed, err := parseTimeout(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring %s in the config: %v\n", key, err)
+		return
+	}
+	*d = parsed
+}
+
+// setCommandTimeout applies the -timeout flag, if given.
+func setCommandTimeout(value string) {
+	if value == "" {
+		return
+	}
+	d, err := parseTimeout(value)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	commandTimeout = d
+}
+
+// interruptContext returns a context for one operation that is cancelled
+// when the user presses Ctrl+C. Until stop is called, Ctrl+C no longer
+// kills ask.
+func interruptContext() (ctx context.Context, stop context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+// surviveInterrupts keeps Ctrl+C from killing ask for the rest of the
+// process, so that in interactive mode it only cancels the operation in
+// progress.
+func surviveInterrupts() {
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt)
+}
+
+// withTimeout bounds ctx by d unless d is zero.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// cancelError explains err if it was caused by ctx ending: a timeout after
+// d, or an interruption. Other errors are returned unchanged.
+func cancelError(ctx context.Context, err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w after %v", errTimedOut, d)
+	case context.Canceled:
+		return errInterrupted
+	}
+	return err
+}
+
+// isCancel reports whether err is an interruption or a timeout reported by
+// cancelError.
+func isCancel(err error) bool {
+	return errors.Is(err, errInterrupted) || errors.Is(err, errTimedOut)
+}
+
+// runContextCommand runs a context command until it exits, times out or is
+// interrupted with Ctrl+C. The output of a command cut short is kept, so
+// that "tail -f app.log" can be stopped once enough has been captured.
+func runContextCommand(cmdStr string) (string, error) {
+	ctx, stop := interruptContext()
+	defer stop()
+	output, err := runShellCommand(ctx, cmdStr)
+	if isCancel(err) && output != "" {
+		fmt.Fprintf(os.Stderr, "Command %v; keeping its output so far.\n", err)
+		return output, nil
+	}
+	return output, err
+}
+
+// prepareCancel makes a command cancellable as a whole: it runs in its own
+// process group, which is killed when its context ends, and its output is
+// abandoned shortly after even if a background process still holds it.
+func prepareCancel(cmd *exec.Cmd) {
+	setProcessGroup(cmd)
+	cmd.WaitDelay = commandWaitDelay
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// codeInstruction is added to the system prompt with -code, so that the
+// answer is a command and nothing else.
+const codeInstruction = "Reply with only the shell command that does this, in a single ```sh code block. Do not explain it."
+
+// printCode prints the command from session's answer, and nothing else, to
+// out for use in shell substitution. It exits non-zero if the answer has no
+// command, or one that isn't valid shell.
+func printCode(session *Session, out io.Writer) {
+	if session.Interrupted {
+		// A command cut short may do something else entirely.
+		fmt.Fprintln(os.Stderr, "The answer was cut short; not printing its command.")
+		os.Exit(1)
+	}
+	cmdStr := extractCommand(session.Answer())
+	if cmdStr == "" {
+		fmt.Fprintln(os.Stderr, "No command found in the answer:")
+		fmt.Fprintln(os.Stderr, session.Answer())
+		os.Exit(1)
+	}
+	if err := checkShellSyntax(cmdStr); err != nil {
+		fmt.Fprintf(os.Stderr, "The command in the answer is not valid shell: %v\n%s\n", err, cmdStr)
+		os.Exit(1)
+	}
+	fmt.Fprintln(out, cmdStr)
+}
+
+// checkShellSyntax returns an error if cmd doesn't parse as a bash script.
+func checkShellSyntax(cmd string) error {
+	_, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(cmd), "")
+	return err
+}
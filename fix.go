@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// defaultFixAttempts is how many fixes interactive mode's autofix asks for
+// when no number is given.
+const defaultFixAttempts = 3
+
+// fixRequest is the refinement sent after a failed run; the run itself
+// (command, result and output) is included by budgetRefinement.
+func fixRequest(run SessionRun) string {
+	status := run.Status()
+	if status == "" {
+		status = run.Error
+	}
+	return fmt.Sprintf("Running the command failed (%s). Fix it and reply with the corrected command in a single code block.", status)
+}
+
+// fixLoop runs cmdStr from session's answer and, while it fails, asks the
+// model for a fix and runs the revised command, up to attempts times. Each
+// command is confirmed as usual, and each fix is stored as a refinement of
+// the session before it. It returns the last session of the chain and
+// whether the last command succeeded.
+func fixLoop(session *Session, cmdStr string, attempts int) (*Session, bool) {
+	for attempt := 1; ; attempt++ {
+		ran := len(session.Runs)
+		err := runCommandInteractively(cmdStr, session)
+		if err == nil && len(session.Runs) > ran {
+			if attempt > 1 {
+				fmt.Println("The command succeeded.")
+			}
+			return session, true
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
+		}
+		if len(session.Runs) == ran {
+			// Cancelled at the confirmation, or it couldn't be started.
+			return session, false
+		}
+		run := session.Runs[len(session.Runs)-1]
+		if run.Error == errInterrupted.Error() {
+			return session, false
+		}
+		if attempt > attempts {
+			fmt.Fprintf(os.Stderr, "Giving up after %d fix attempt(s).\n", attempts)
+			return session, false
+		}
+
+		fmt.Fprintf(os.Stderr, "Asking for a fix (attempt %d of %d)...\n", attempt, attempts)
+		ctx, stop := interruptContext()
+		next, err := refineSession(ctx, session, fixRequest(run), nil, os.Stdout)
+		stop()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting a fix: %v\n", err)
+			return session, false
+		}
+		session = next
+		if session.Interrupted {
+			return session, false
+		}
+		if cmdStr = extractCommand(session.Answer()); cmdStr == "" {
+			fmt.Fprintln(os.Stderr, "No runnable command found in the revised answer.")
+			return session, false
+		}
+	}
+}
@@ -4,7 +4,15 @@ go 1.22.7
 
 require (
 	github.com/chzyer/readline v1.5.1
+	github.com/creack/pty v1.1.21
+	github.com/pkoukk/tiktoken-go v0.1.7
+	github.com/pkoukk/tiktoken-go-loader v0.0.2
 	github.com/sashabaranov/go-openai v1.36.0
+	golang.org/x/sys v0.10.0
+	mvdan.cc/sh/v3 v3.7.0
 )
 
-require golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
+require (
+	github.com/dlclark/regexp2 v1.10.0 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+)
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// rpcMessage is a JSON-RPC 2.0 request, notification or response; which
+// one is told by the fields set. Notifications have no ID, and responses
+// have no method.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+// rpcError is the error of a failed JSON-RPC request.
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// Error codes defined by JSON-RPC 2.0.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+)
+
+func (m rpcMessage) isRequest() bool {
+	return m.Method != "" && len(m.ID) > 0
+}
+
+func (m rpcMessage) isResponse() bool {
+	return m.Method == "" && len(m.ID) > 0
+}
+
+// rpcWriter writes JSON-RPC messages, one per line. It is safe for
+// concurrent use.
+type rpcWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *rpcWriter) send(msg rpcMessage) error {
+	msg.JSONRPC = "2.0"
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.w.Write(append(data, '\n'))
+	return err
+}
+
+// reply answers the request with the given ID with result, or with rerr if
+// it is not nil.
+func (w *rpcWriter) reply(id json.RawMessage, result interface{}, rerr *rpcError) error {
+	msg := rpcMessage{ID: id, Error: rerr}
+	if rerr == nil {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		msg.Result = raw
+	}
+	return w.send(msg)
+}
+
+func (w *rpcWriter) notify(method string, params interface{}) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return w.send(rpcMessage{Method: method, Params: raw})
+}
+
+// rpcCalls tracks the requests a server runs in the background, so that
+// they can be cancelled by ID and waited for.
+type rpcCalls struct {
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// start registers the request with the given ID and returns its context and
+// a function to call once it is done.
+func (c *rpcCalls) start(id json.RawMessage) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.mu.Lock()
+	if c.running == nil {
+		c.running = map[string]context.CancelFunc{}
+	}
+	c.running[string(id)] = cancel
+	c.mu.Unlock()
+	c.wg.Add(1)
+	return ctx, func() {
+		c.mu.Lock()
+		delete(c.running, string(id))
+		c.mu.Unlock()
+		cancel()
+		c.wg.Done()
+	}
+}
+
+// cancel cancels the request with the given ID and reports whether it was
+// running.
+func (c *rpcCalls) cancel(id json.RawMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancel := c.running[string(id)]
+	if cancel != nil {
+		cancel()
+	}
+	return cancel != nil
+}
+
+func (c *rpcCalls) wait() {
+	c.wg.Wait()
+}
+
+// readRPCLines calls handle with each non-empty line read from r until it
+// ends.
+func readRPCLines(r io.Reader, handle func(line []byte)) {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			handle(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
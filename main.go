@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -15,6 +14,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/chzyer/readline"
@@ -24,44 +24,121 @@ import (
 const (
 	historyDirName     = ".ask/sessions"
 	configFileName     = ".ask/config.json"
-	pendingContextFile = ".ask/pending_context.txt"
+	pendingContextFile = ".ask/pending_context.json"
+
+	legacyPendingContextFile = ".ask/pending_context.txt"
+
+	scissorsLine = "------------------------ >8 ------------------------"
 )
 
 var (
-	apiKey        = ""
-	editor        = os.Getenv("EDITOR")
-	model         = "gpt-4" // Default model if none set in config
-	debugMode     bool
-	maxTokens     = 1000000 // default max tokens if not set by user
-	charsPerToken = 4       // approximate chars per token
+	apiKey          = ""
+	anthropicAPIKey = ""
+	editor          = os.Getenv("EDITOR")
+	model           = "" // Resolved from config, -model, or the provider's default
+	providerName    = providerOpenAI
+	baseURL         = "" // Overrides the provider's default endpoint
+	debugMode       bool
+	maxTokens       = 0 // caps the prompt budget; 0 uses the model's context window
 )
 
 type Config struct {
-	APIKey    string `json:"api_key"`
-	Model     string `json:"model"`
-	MaxTokens int    `json:"max_tokens"` // user-configurable max tokens
+	APIKey          string `json:"api_key"`
+	AnthropicAPIKey string `json:"anthropic_api_key,omitempty"`
+	Provider        string `json:"provider,omitempty"` // openai, local or anthropic
+	BaseURL         string `json:"base_url,omitempty"`
+	Model           string `json:"model"`
+	MaxTokens       int    `json:"max_tokens"` // user-configurable max tokens
+
+	// Models adds to or overrides the built-in model registry, keyed by
+	// model ID or ID prefix.
+	Models map[string]ModelInfo `json:"models,omitempty"`
+
+	// TrimPolicy and ErrorPatterns control how over-budget context is cut.
+	TrimPolicy    string   `json:"trim_policy,omitempty"`
+	ErrorPatterns []string `json:"error_patterns,omitempty"`
+
+	// Risk adds to or disables the rules that flag dangerous commands.
+	Risk *RiskConfig `json:"risk,omitempty"`
+
+	// Sandbox runs extracted commands in a sandbox by default.
+	Sandbox bool `json:"sandbox,omitempty"`
+
+	// PTY runs extracted commands on a pseudo-terminal by default.
+	PTY bool `json:"pty,omitempty"`
+
+	// Tools sets the approval policy ("allow", "ask" or "deny") of the
+	// tools the model may call, by tool name.
+	Tools map[string]string `json:"tools,omitempty"`
+
+	// DisableTools stops offering tools to the model.
+	DisableTools bool `json:"disable_tools,omitempty"`
+
+	// MCPServers are Model Context Protocol servers whose tools are offered
+	// to the model, by server name.
+	MCPServers map[string]MCPServer `json:"mcp_servers,omitempty"`
+
+	// APITimeout and CommandTimeout are durations such as "90s"; "0"
+	// disables the limit.
+	APITimeout     string `json:"api_timeout,omitempty"`
+	CommandTimeout string `json:"command_timeout,omitempty"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxInitArg {
+		sandboxInit(os.Args[2:])
+		return
+	}
 	loadAPIKey()
 
 	// Define subcommands
 	refineCmd := flag.NewFlagSet("refine", flag.ExitOnError)
+	continueCmd := flag.NewFlagSet("continue", flag.ExitOnError)
 	interactiveCmd := flag.NewFlagSet("interactive", flag.ExitOnError)
 	contextCmd := flag.NewFlagSet("context", flag.ExitOnError)
 	configCmd := flag.NewFlagSet("config", flag.ExitOnError)
 	modelsCmd := flag.NewFlagSet("models", flag.ExitOnError)
+	untilCmd := flag.NewFlagSet("until", flag.ExitOnError)
+	mcpServeCmd := flag.NewFlagSet("mcp-serve", flag.ExitOnError)
+	serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	rpcCmd := flag.NewFlagSet("rpc", flag.ExitOnError)
 
 	var fileFlag string
 	var runFlag bool
+	var codeFlag bool
+	var fixFlag int
 	var debugFlag bool
 	var modelFlag string
+	var providerFlag string
+	var sessionFlag string
+	var trimFlag string
+	var attachFlag stringList
+	var timeoutFlag string
+	var outputFlag string
+	attachUsage := "Attach a file, directory or glob as context (repeatable)"
+	sandboxUsage := "Run commands from the answer in a sandbox and review their file changes"
+	toolsUsage := "Let the model call local tools (read_file, list_dir, grep, ...) if it supports tool calling"
+	ptyUsage := "Run commands from the answer on a terminal, for interactive programs"
+	codeUsage := "Ask for a command only and print just that command, for use in $(...)"
+	fixUsage := "Run the command and, while it fails, ask for a fix and retry up to N times (implies -run)"
+	timeoutUsage := "Time limit for each command run, e.g. 30s or 5m (0 for none; default from config or 10m)"
+	trimUsage := "How to trim context that doesn't fit the prompt budget (oldest, headtail, errors)"
 
 	// Global flags for main command
 	flag.StringVar(&fileFlag, "f", "", "file path containing prompt")
 	flag.BoolVar(&runFlag, "run", false, "immediately run the resulting command if feasible")
+	flag.BoolVar(&codeFlag, "code", false, codeUsage)
+	flag.IntVar(&fixFlag, "fix", 0, fixUsage)
+	flag.BoolVar(&sandboxMode, "sandbox", sandboxMode, sandboxUsage)
+	flag.BoolVar(&ptyMode, "pty", ptyMode, ptyUsage)
+	flag.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+	flag.StringVar(&timeoutFlag, "timeout", "", timeoutUsage)
 	flag.BoolVar(&debugFlag, "debug", false, "enable debug output")
-	flag.StringVar(&modelFlag, "model", "", "Override the OpenAI model to use (e.g., gpt-4, gpt-3.5-turbo)")
+	flag.StringVar(&modelFlag, "model", "", "Override the model to use (e.g., gpt-4, gpt-3.5-turbo)")
+	flag.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+	flag.StringVar(&trimFlag, "trim", "", trimUsage)
+	flag.Var(&attachFlag, "a", attachUsage)
+	flag.StringVar(&outputFlag, "o", "", outputUsage)
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `Usage: ask [options] [prompt]
@@ -69,11 +146,17 @@ func main() {
 If prompt is omitted, an editor is opened. You can add context before sending.
 
 Subcommands:
-  refine       Refine the last session's response with additional context.
+  refine       Refine the last session's response (or -session <id>) with additional context.
+  continue     Continue the conversation of any stored session.
   interactive  Enter an interactive mode.
   context      Add shell command output as context to the last or future session.
-  config       Manage configuration (store API key, model, or max-tokens).
-  models       List available models from the API.
+  until        Ask for commands and run them until a check command passes.
+  config       Manage configuration (API keys, provider, model, or max-tokens).
+  models       List available models from the provider.
+  sessions     List, show, search and delete stored sessions.
+  serve        Serve a JSON HTTP API (ask, refine, sessions, context) on localhost or a Unix socket.
+  rpc          Speak line-delimited JSON-RPC on stdin/stdout, for editor plugins.
+  mcp-serve    Offer ask, refine_session, list_sessions and extract_commands as MCP tools on stdio.
 
 Options:
 `)
@@ -82,11 +165,26 @@ Options:
 Examples:
   ask "How to list all files?"
   ask -run "Generate a command to list files"
+  ls -la $(ask -code "command that prints the Go module cache path")
+  ask -run -sandbox "Rename all .jpeg files to .jpg"
+  ask -run -pty "Open an interactive rebase of the last 3 commits"
+  ask -run -timeout 30s "Watch the nginx error log"
+  ask -run -fix 3 "Build this project with make"
+  ask until "go test ./..." "Fix the failing tests"
+  ask -a main.go -a 'internal/**/*.go' "Where is the config loaded?"
+  cat build.log | ask "Why did this fail?"
   ask refine
+  ask continue 20240501-101500 "now do the same for tar"
   ask config set-key <YOUR_API_KEY>
   ask config set-model gpt-3.5-turbo
   ask config set-max-tokens 8192
+  ask config set-provider local
+  ask -provider anthropic -model claude-3-5-sonnet-latest "Explain this error"
   ask models
+  ask sessions list
+  ask sessions grep -i "docker"
+  ask -o json "Find files over 1GB" | jq -r .answer
+  ask serve -socket ~/.ask/ask.sock
 
 Use 'ask <subcommand> -h' for subcommand help.
 `)
@@ -95,11 +193,11 @@ Use 'ask <subcommand> -h' for subcommand help.
 	if len(os.Args) < 2 {
 		// No subcommand, just run main ask logic
 		flag.Parse()
-		debugMode = debugFlag
-		if modelFlag != "" {
-			model = modelFlag
-		}
-		handleAsk("", fileFlag, runFlag)
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setCommandTimeout(timeoutFlag)
+		setOutputFormat(outputFlag)
+		handleAsk("", fileFlag, runFlag, fixFlag, codeFlag, attachFlag)
 		return
 	}
 
@@ -111,45 +209,106 @@ Use 'ask <subcommand> -h' for subcommand help.
 	switch os.Args[1] {
 	case "refine":
 		refineCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
-		refineCmd.StringVar(&modelFlag, "model", "", "Override the OpenAI model to use")
+		refineCmd.StringVar(&modelFlag, "model", "", "Override the model to use")
+		refineCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		refineCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		refineCmd.Var(&attachFlag, "a", attachUsage)
+		refineCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		refineCmd.StringVar(&outputFlag, "o", "", outputUsage)
+		refineCmd.StringVar(&sessionFlag, "session", "", "Session to refine (ID, unique ID prefix, or 'last')")
 		refineCmd.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage: ask refine [options] [refinement text]\n")
 			refineCmd.PrintDefaults()
 		}
 		refineCmd.Parse(os.Args[2:])
-		debugMode = debugFlag
-		if modelFlag != "" {
-			model = modelFlag
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setOutputFormat(outputFlag)
+		handleRefine(sessionFlag, refineCmd.Args(), attachFlag)
+
+	case "continue":
+		continueCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
+		continueCmd.StringVar(&modelFlag, "model", "", "Override the model to use")
+		continueCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		continueCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		continueCmd.Var(&attachFlag, "a", attachUsage)
+		continueCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		continueCmd.StringVar(&outputFlag, "o", "", outputUsage)
+		continueCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: ask continue [options] <session> [message]\n")
+			continueCmd.PrintDefaults()
 		}
-		handleRefine(refineCmd.Args())
+		continueCmd.Parse(os.Args[2:])
+		if continueCmd.NArg() < 1 {
+			continueCmd.Usage()
+			os.Exit(1)
+		}
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setOutputFormat(outputFlag)
+		handleRefine(continueCmd.Arg(0), continueCmd.Args()[1:], attachFlag)
 
 	case "interactive":
 		interactiveCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
-		interactiveCmd.StringVar(&modelFlag, "model", "", "Override the OpenAI model")
+		interactiveCmd.StringVar(&modelFlag, "model", "", "Override the model")
+		interactiveCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		interactiveCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		interactiveCmd.BoolVar(&sandboxMode, "sandbox", sandboxMode, sandboxUsage)
+		interactiveCmd.BoolVar(&ptyMode, "pty", ptyMode, ptyUsage)
+		interactiveCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		interactiveCmd.StringVar(&timeoutFlag, "timeout", "", timeoutUsage)
 		interactiveCmd.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage: ask interactive [options]\n")
 			interactiveCmd.PrintDefaults()
 		}
 		interactiveCmd.Parse(os.Args[2:])
-		debugMode = debugFlag
-		if modelFlag != "" {
-			model = modelFlag
-		}
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setCommandTimeout(timeoutFlag)
 		handleInteractive(interactiveCmd.Args())
 
+	case "until":
+		untilCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
+		untilCmd.StringVar(&modelFlag, "model", "", "Override the model")
+		untilCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		untilCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		untilCmd.Var(&attachFlag, "a", attachUsage)
+		untilCmd.BoolVar(&sandboxMode, "sandbox", sandboxMode, sandboxUsage)
+		untilCmd.BoolVar(&ptyMode, "pty", ptyMode, ptyUsage)
+		untilCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		untilCmd.StringVar(&timeoutFlag, "timeout", "", timeoutUsage)
+		attemptsFlag := untilCmd.Int("attempts", defaultUntilAttempts, "Give up after this many answers")
+		tokensFlag := untilCmd.Int("tokens", 0, "Give up once this many tokens have been used (0 for no limit)")
+		untilCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: ask until [options] <check command> <task>\n")
+			untilCmd.PrintDefaults()
+		}
+		untilCmd.Parse(os.Args[2:])
+		if untilCmd.NArg() < 2 || *attemptsFlag < 1 || *tokensFlag < 0 {
+			untilCmd.Usage()
+			os.Exit(1)
+		}
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setCommandTimeout(timeoutFlag)
+		handleUntil(untilCmd.Arg(0), strings.Join(untilCmd.Args()[1:], " "), *attemptsFlag, *tokensFlag, attachFlag)
+
 	case "context":
 		contextCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
+		filesFlag := contextCmd.Bool("f", false, "Attach the arguments as files, directories or globs instead of running a command")
+		contextCmd.StringVar(&timeoutFlag, "timeout", "", "Time limit for the command, e.g. 30s (0 for none)")
 		contextCmd.Usage = func() {
-			fmt.Fprintf(os.Stderr, "Usage: ask context [options] <command>\n")
+			fmt.Fprintf(os.Stderr, "Usage: ask context [options] <command>\n       ask context -f <path>...\n")
 			contextCmd.PrintDefaults()
 		}
 		contextCmd.Parse(os.Args[2:])
-		debugMode = debugFlag
-		handleContext(contextCmd.Args())
+		applyFlags(debugFlag, "", "")
+		setCommandTimeout(timeoutFlag)
+		handleContext(contextCmd.Args(), *filesFlag)
 
 	case "config":
 		configCmd.Usage = func() {
-			fmt.Fprintf(os.Stderr, "Usage:\n  ask config set-key <YOUR_API_KEY>\n  ask config set-model <MODEL>\n  ask config set-max-tokens <NUMBER>\n")
+			fmt.Fprintf(os.Stderr, "Usage:\n  ask config set-key <YOUR_API_KEY>\n  ask config set-anthropic-key <YOUR_API_KEY>\n  ask config set-provider <openai|local|anthropic>\n  ask config set-base-url <URL>\n  ask config set-model <MODEL>\n  ask config set-max-tokens <NUMBER>\n  ask config set-trim-policy <oldest|headtail|errors>\n")
 			configCmd.PrintDefaults()
 		}
 		configCmd.Parse(os.Args[2:])
@@ -157,67 +316,182 @@ Use 'ask <subcommand> -h' for subcommand help.
 
 	case "models":
 		modelsCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
-		modelsCmd.StringVar(&modelFlag, "model", "", "Override the OpenAI model")
+		modelsCmd.StringVar(&modelFlag, "model", "", "Override the model")
+		modelsCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		registryFlag := modelsCmd.Bool("registry", false, "List the model registry instead of querying the provider")
+		modelsCmd.StringVar(&outputFlag, "o", "", outputUsage)
 		modelsCmd.Usage = func() {
 			fmt.Fprintf(os.Stderr, "Usage: ask models [options]\n")
 			modelsCmd.PrintDefaults()
 		}
 		modelsCmd.Parse(os.Args[2:])
-		debugMode = debugFlag
-		if modelFlag != "" {
-			model = modelFlag
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setOutputFormat(outputFlag)
+		handleModels(*registryFlag)
+
+	case "sessions":
+		handleSessions(os.Args[2:])
+
+	case "serve":
+		serveCmd.BoolVar(&debugFlag, "debug", false, "enable debug output")
+		serveCmd.StringVar(&modelFlag, "model", "", "Override the default model")
+		serveCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		serveCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		serveCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		serveCmd.StringVar(&timeoutFlag, "timeout", "", "Time limit for context commands, e.g. 30s (0 for none)")
+		addrFlag := serveCmd.String("addr", defaultServeAddr, "Loopback address and port to listen on")
+		socketFlag := serveCmd.String("socket", "", "Listen on this Unix socket instead of -addr")
+		serveCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: ask serve [options]\n")
+			serveCmd.PrintDefaults()
 		}
-		handleModels()
+		serveCmd.Parse(os.Args[2:])
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setCommandTimeout(timeoutFlag)
+		handleServe(*addrFlag, *socketFlag)
+
+	case "rpc":
+		rpcCmd.BoolVar(&debugFlag, "debug", false, "enable debug output (on stderr)")
+		rpcCmd.StringVar(&modelFlag, "model", "", "Override the default model")
+		rpcCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		rpcCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		rpcCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		rpcCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: ask rpc [options]\n")
+			rpcCmd.PrintDefaults()
+		}
+		rpcCmd.Parse(os.Args[2:])
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		handleRPC()
+
+	case "mcp-serve":
+		mcpServeCmd.BoolVar(&debugFlag, "debug", false, "enable debug output (on stderr)")
+		mcpServeCmd.StringVar(&modelFlag, "model", "", "Override the model")
+		mcpServeCmd.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		mcpServeCmd.StringVar(&trimFlag, "trim", "", trimUsage)
+		mcpServeCmd.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		mcpServeCmd.Usage = func() {
+			fmt.Fprintf(os.Stderr, "Usage: ask mcp-serve [options]\n")
+			mcpServeCmd.PrintDefaults()
+		}
+		mcpServeCmd.Parse(os.Args[2:])
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		handleMCPServe()
 
 	default:
 		// Treat as main ask command with prompt
 		flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 		flag.CommandLine.StringVar(&fileFlag, "f", "", "file path containing prompt")
 		flag.CommandLine.BoolVar(&runFlag, "run", false, "immediately run the resulting command if feasible")
+		flag.CommandLine.BoolVar(&codeFlag, "code", false, codeUsage)
+		flag.CommandLine.IntVar(&fixFlag, "fix", 0, fixUsage)
+		flag.CommandLine.BoolVar(&sandboxMode, "sandbox", sandboxMode, sandboxUsage)
+		flag.CommandLine.BoolVar(&ptyMode, "pty", ptyMode, ptyUsage)
+		flag.CommandLine.BoolVar(&toolsMode, "tools", toolsMode, toolsUsage)
+		flag.CommandLine.StringVar(&timeoutFlag, "timeout", "", timeoutUsage)
 		flag.CommandLine.BoolVar(&debugFlag, "debug", false, "enable debug output")
-		flag.CommandLine.StringVar(&modelFlag, "model", "", "Override the OpenAI model")
+		flag.CommandLine.StringVar(&modelFlag, "model", "", "Override the model")
+		flag.CommandLine.StringVar(&providerFlag, "provider", "", "Override the provider (openai, local, anthropic)")
+		flag.CommandLine.StringVar(&trimFlag, "trim", "", trimUsage)
+		flag.CommandLine.Var(&attachFlag, "a", attachUsage)
+		flag.CommandLine.StringVar(&outputFlag, "o", "", outputUsage)
 		flag.CommandLine.Usage = flag.Usage
 		flag.CommandLine.Parse(os.Args[1:])
 
-		debugMode = debugFlag
-		if modelFlag != "" {
-			model = modelFlag
-		}
+		applyFlags(debugFlag, modelFlag, providerFlag)
+		setTrimPolicy(trimFlag)
+		setCommandTimeout(timeoutFlag)
+		setOutputFormat(outputFlag)
 		args := flag.CommandLine.Args()
 		var prompt string
 		if len(args) > 0 {
 			prompt = strings.Join(args, " ")
 		}
-		handleAsk(prompt, fileFlag, runFlag)
+		handleAsk(prompt, fileFlag, runFlag, fixFlag, codeFlag, attachFlag)
 	}
 }
 
+// loadAPIKey loads credentials and defaults from the config file and
+// environment. Missing keys are reported by newProvider, since which key is
+// needed depends on the provider selected on the command line.
 func loadAPIKey() {
 	cfg, err := loadConfig()
 	if err == nil && cfg != nil {
 		if cfg.APIKey != "" {
 			apiKey = decodeBase64(cfg.APIKey)
 		}
+		if cfg.AnthropicAPIKey != "" {
+			anthropicAPIKey = decodeBase64(cfg.AnthropicAPIKey)
+		}
+		if cfg.Provider != "" {
+			providerName = cfg.Provider
+		}
+		if cfg.BaseURL != "" {
+			baseURL = cfg.BaseURL
+		}
 		if cfg.Model != "" {
 			model = cfg.Model // load default model from config
 		}
 		if cfg.MaxTokens > 0 {
 			maxTokens = cfg.MaxTokens
 		}
+		userModels = lowerModelKeys(cfg.Models)
+		if validTrimPolicy(cfg.TrimPolicy) {
+			trimPolicy = cfg.TrimPolicy
+		}
+		errorPatterns = cfg.ErrorPatterns
+		if cfg.Risk != nil {
+			riskConfig = *cfg.Risk
+		}
+		sandboxMode = cfg.Sandbox
+		ptyMode = cfg.PTY
+		toolsMode = !cfg.DisableTools
+		for name, policy := range cfg.Tools {
+			if !validToolPolicy(policy) {
+				fmt.Fprintf(os.Stderr, "Warning: ignoring tool policy %q for %s in the config: use allow, ask or deny\n", policy, name)
+			}
+		}
+		toolPolicies = cfg.Tools
+		mcpServers = cfg.MCPServers
+		configTimeout(&apiTimeout, cfg.APITimeout, "api_timeout")
+		configTimeout(&commandTimeout, cfg.CommandTimeout, "command_timeout")
 	} else if debugMode {
 		fmt.Fprintf(os.Stderr, "[DEBUG] No valid config found or error loading config: %v\n", err)
 	}
 
 	if apiKey == "" {
 		apiKey = os.Getenv("OPENAI_API_KEY")
-		if apiKey == "" {
-			fmt.Fprintln(os.Stderr, "No API key found. Set OPENAI_API_KEY or run `ask config set-key <YOUR_API_KEY>`.")
-			os.Exit(1)
+	}
+	if anthropicAPIKey == "" {
+		anthropicAPIKey = os.Getenv("ANTHROPIC_API_KEY")
+	}
+}
+
+// applyFlags applies the flags shared by most subcommands on top of the
+// values loaded from the config.
+func applyFlags(debug bool, modelOverride, providerOverride string) {
+	debugMode = debug
+	if providerOverride != "" {
+		if providerOverride != providerName {
+			// The configured model and endpoint most likely belong to the
+			// configured provider, so fall back to the new provider's defaults.
+			model = ""
+			baseURL = ""
 		}
+		providerName = providerOverride
+	}
+	if modelOverride != "" {
+		model = modelOverride
+	}
+	if model == "" {
+		model = defaultModels[providerName]
 	}
 
 	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Loaded API key, model=%s, max_tokens=%d\n", model, maxTokens)
+		fmt.Fprintf(os.Stderr, "[DEBUG] Loaded config, provider=%s, model=%s, max_tokens=%d, prompt budget=%d\n", providerName, model, maxTokens, promptBudget())
 	}
 }
 
@@ -258,8 +532,12 @@ func handleConfig(args []string) {
 	if len(args) < 1 {
 		fmt.Println("Usage:")
 		fmt.Println("  ask config set-key <API_KEY>")
+		fmt.Println("  ask config set-anthropic-key <API_KEY>")
+		fmt.Println("  ask config set-provider <openai|local|anthropic>")
+		fmt.Println("  ask config set-base-url <URL>")
 		fmt.Println("  ask config set-model <MODEL>")
 		fmt.Println("  ask config set-max-tokens <NUMBER>")
+		fmt.Println("  ask config set-trim-policy <oldest|headtail|errors>")
 		return
 	}
 	switch args[0] {
@@ -281,6 +559,60 @@ func handleConfig(args []string) {
 			os.Exit(1)
 		}
 		fmt.Println("API Key saved to config.")
+	case "set-anthropic-key":
+		if len(args) < 2 {
+			fmt.Println("Usage: ask config set-anthropic-key <API_KEY>")
+			return
+		}
+		enc := base64.StdEncoding.EncodeToString([]byte(args[1]))
+		cfg, _ := loadConfig()
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		cfg.AnthropicAPIKey = enc
+		err := saveConfig(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Anthropic API Key saved to config.")
+	case "set-provider":
+		if len(args) < 2 {
+			fmt.Println("Usage: ask config set-provider <openai|local|anthropic>")
+			return
+		}
+		name := args[1]
+		if _, ok := defaultModels[name]; !ok {
+			fmt.Printf("Unknown provider '%s'. Available: openai, local, anthropic\n", name)
+			return
+		}
+		cfg, _ := loadConfig()
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		cfg.Provider = name
+		err := saveConfig(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Provider '%s' saved to config.\n", name)
+	case "set-base-url":
+		if len(args) < 2 {
+			fmt.Println("Usage: ask config set-base-url <URL>  (use \"\" to reset to the provider default)")
+			return
+		}
+		cfg, _ := loadConfig()
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		cfg.BaseURL = args[1]
+		err := saveConfig(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Base URL '%s' saved to config.\n", args[1])
 	case "set-model":
 		if len(args) < 2 {
 			fmt.Println("Usage: ask config set-model <MODEL>")
@@ -321,8 +653,28 @@ func handleConfig(args []string) {
 			os.Exit(1)
 		}
 		fmt.Printf("Max tokens '%d' saved to config.\n", val)
+	case "set-trim-policy":
+		if len(args) < 2 {
+			fmt.Println("Usage: ask config set-trim-policy <oldest|headtail|errors>")
+			return
+		}
+		if !validTrimPolicy(args[1]) {
+			fmt.Printf("Unknown trim policy '%s'. Available: %s\n", args[1], strings.Join(trimPolicies, ", "))
+			return
+		}
+		cfg, _ := loadConfig()
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		cfg.TrimPolicy = args[1]
+		err := saveConfig(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Trim policy '%s' saved to config.\n", args[1])
 	default:
-		fmt.Println("Unknown config command. Available: set-key, set-model, set-max-tokens")
+		fmt.Println("Unknown config command. Available: set-key, set-anthropic-key, set-provider, set-base-url, set-model, set-max-tokens, set-trim-policy")
 	}
 }
 
@@ -334,7 +686,36 @@ func decodeBase64(encoded string) string {
 	return string(decoded)
 }
 
-func handleAsk(prompt, filePath string, run bool) {
+func handleAsk(prompt, filePath string, run bool, fix int, code bool, attach []string) {
+	if outputFormat != outputText && (run || fix > 0) {
+		fmt.Fprintf(os.Stderr, "Error: -o %s can't be combined with -run or -fix\n", outputFormat)
+		os.Exit(1)
+	}
+	if code && (run || fix > 0 || outputFormat != outputText) {
+		fmt.Fprintln(os.Stderr, "Error: -code can't be combined with -run, -fix or -o")
+		os.Exit(1)
+	}
+	var entries []ContextEntry
+	attached, err := collectAttachments(attach)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error attaching files: %v\n", err)
+		os.Exit(1)
+	}
+	var piped []ContextEntry
+	if stdinHasInput() {
+		data := readPipedStdin()
+		if prompt == "" && filePath == "" {
+			// Nothing else was given, so the piped data is the prompt.
+			prompt = strings.TrimSpace(data)
+			if prompt == "" {
+				fmt.Fprintln(os.Stderr, "No prompt provided.")
+				os.Exit(1)
+			}
+		} else if strings.TrimSpace(data) != "" {
+			piped = append(piped, stdinContext(data))
+		}
+	}
+
 	if prompt == "" && filePath != "" {
 		data, err := ioutil.ReadFile(filePath)
 		if err != nil {
@@ -343,138 +724,180 @@ func handleAsk(prompt, filePath string, run bool) {
 		}
 		prompt = string(data)
 	} else if prompt == "" && filePath == "" {
+		if code {
+			fmt.Fprintln(os.Stderr, "Error: -code needs a prompt, as arguments, with -f or on stdin")
+			os.Exit(1)
+		}
 		edited, err := openEditor("")
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to open editor: %v\n", err)
 			os.Exit(1)
 		}
-		prompt = edited
-		prompt = runInitialContextLoop(prompt)
+		// With -o, stdout carries only the JSON result.
+		var info io.Writer = os.Stdout
+		if outputFormat != outputText {
+			info = os.Stderr
+		}
+		prompt, entries = runInitialContextLoop(edited, info)
 	}
 
 	pending := loadPendingContext()
-	if pending != "" {
-		prompt += "\n\nAdditional Context:\n" + pending
+	if len(pending) > 0 {
+		entries = append(entries, pending...)
 		clearPendingContext()
 	}
+	entries = append(entries, attached...)
+	entries = append(entries, piped...)
 
 	if prompt == "" {
 		fmt.Fprintln(os.Stderr, "No prompt provided.")
 		os.Exit(1)
 	}
 
-	// Apply length limit based on max_tokens
-	maxChars := maxTokens * charsPerToken
-	if len(prompt) > maxChars {
-		// Truncate prompt itself if needed
-		prompt = prompt[:maxChars]
-	} else {
-		// If prompt + context are too long, try truncating context portion
-		// Actually, we've already combined the prompt and context into `prompt`
-		// So we can attempt a smarter truncation here:
-		// We'll look for the "Additional Context:\n" marker and try truncating from there.
-		index := strings.Index(prompt, "Additional Context:\n")
-		if index > -1 {
-			// If overall too long, truncate from end of the prompt
-			if len(prompt) > maxChars {
-				overage := len(prompt) - maxChars
-				// Truncate from the end of context
-				contextStart := index + len("Additional Context:\n")
-				contextLen := len(prompt) - contextStart
-				if contextLen > overage {
-					// Just remove overage from context end
-					newContextEnd := len(prompt) - overage
-					prompt = prompt[:newContextEnd]
-				} else {
-					// Overage bigger than entire context, remove context entirely
-					prompt = prompt[:index]
-				}
-			}
-		} else {
-			// No additional context marker and still too long?
-			if len(prompt) > maxChars {
-				prompt = prompt[:maxChars]
-			}
-		}
-	}
-
-	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Asking prompt (len=%d, maxChars=%d):\n%s\n", len(prompt), maxChars, prompt)
+	out := answerOutput()
+	var instruction string
+	if code {
+		// Only the command is printed, once the answer is complete.
+		instruction = codeInstruction
+		out = ioutil.Discard
 	}
 
-	answer, err := askChatGPT(prompt)
+	ctx, stop := interruptContext()
+	session, err := askNewSession(ctx, prompt, instruction, entries, out)
+	stop()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error getting response: %v\n", err)
 		os.Exit(1)
 	}
-
-	sessionPath, err := storeSession(prompt, answer, prompt)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
+	answer := session.Answer()
+	if code {
+		printCode(session, os.Stdout)
+		return
+	}
+	if outputFormat != outputText {
+		printAnswerResult(session)
+		if session.Interrupted {
+			os.Exit(1)
+		}
+		return
 	}
 
-	fmt.Println(answer)
-
-	if run {
+	if session.Interrupted {
+		fmt.Fprintf(os.Stderr, "Partial session stored in: %s\n", session.Dir())
+		os.Exit(1)
+	}
+	if fix > 0 {
+		cmdStr := extractCommand(answer)
+		if cmdStr == "" {
+			fmt.Fprintln(os.Stderr, "No runnable command found in the answer.")
+			return
+		}
+		last, ok := fixLoop(session, cmdStr, fix)
+		if last != session {
+			fmt.Fprintf(os.Stderr, "Session stored in: %s\n", last.Dir())
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	} else if run {
 		cmdStr := extractCommand(answer)
 		if cmdStr != "" {
-			if err := runCommandInteractively(cmdStr, sessionPath); err != nil {
+			if err := runCommandInteractively(cmdStr, session); err != nil {
 				fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
 			}
 		} else {
 			fmt.Fprintln(os.Stderr, "No runnable command found in the answer.")
 		}
 	} else {
-		fmt.Fprintf(os.Stderr, "Session stored in: %s\n", sessionPath)
+		fmt.Fprintf(os.Stderr, "Session stored in: %s\n", session.Dir())
 	}
 }
 
-func runInitialContextLoop(initialPrompt string) string {
+// askNewSession fits entries around prompt, asks the model, streaming the
+// answer to out, and stores the new session. A non-empty instruction is
+// added to the system prompt for this answer only. A session whose answer
+// was cut short is stored too and returned with Interrupted set.
+func askNewSession(ctx context.Context, prompt, instruction string, entries []ContextEntry, out io.Writer) (*Session, error) {
+	// Fit the context around the question; the question itself is kept.
+	prompt, kept, report := budgetTurn(nil, prompt, contextItems(entries), askLayout)
+	report.Print(os.Stderr)
+	markTrimmed(entries, kept)
+
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Asking prompt (tokens=%d, budget=%d, tokenizer=%s):\n%s\n", countTokens(prompt), report.Budget, tokenizerForModel(model), prompt)
+	}
+
+	session := newSession([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: prompt}}, nil)
+	session.ContextTrimmed = report.Trimmed()
+	session.instruction = instruction
+	for _, e := range entries {
+		e.Included = true
+		session.Context = append(session.Context, e)
+	}
+	if _, err := answerSessionContext(ctx, session, out); err != nil {
+		return nil, err
+	}
+	if err := createSession(session); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
+	}
+	return session, nil
+}
+
+// runInitialContextLoop lets the user add context before a new prompt is
+// sent, showing its prompts and messages on w. It returns the (possibly
+// re-edited) prompt and the context gathered.
+func runInitialContextLoop(initialPrompt string, w io.Writer) (string, []ContextEntry) {
 	rl, err := readline.NewEx(&readline.Config{
 		Prompt:      "(context mode) > ",
 		HistoryFile: filepath.Join(os.TempDir(), "ask_temp_history.txt"),
+		Stdout:      w,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing line editor: %v\n", err)
-		return initialPrompt
+		return initialPrompt, nil
 	}
 	defer rl.Close()
 
-	fmt.Println("You may now add context or edit the prompt before finalizing.")
-	fmt.Println("Commands:")
-	fmt.Println(":context <cmd> - Run a shell command and add its output as context")
-	fmt.Println(":edit          - Re-edit the prompt")
-	fmt.Println(":done          - Finalize and send the prompt to ChatGPT")
-	fmt.Println("(Use up/down arrows to cycle through history)")
+	fmt.Fprintln(w, "You may now add context or edit the prompt before finalizing.")
+	fmt.Fprintln(w, "Commands:")
+	fmt.Fprintln(w, ":context <cmd> - Run a shell command and add its output as context")
+	fmt.Fprintln(w, ":attach <path> - Attach files, directories or globs as context")
+	fmt.Fprintln(w, ":edit          - Re-edit the prompt")
+	fmt.Fprintln(w, ":done          - Finalize and send the prompt to ChatGPT")
+	fmt.Fprintln(w, "(Use up/down arrows to cycle through history)")
 
-	var extraContext strings.Builder
+	var entries []ContextEntry
 	prompt := initialPrompt
 
 	for {
 		line, err := rl.Readline()
 		if err == readline.ErrInterrupt || err == io.EOF {
-			return prompt
+			return prompt, entries
 		}
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
 		if line == ":done" {
-			if extraContext.Len() > 0 {
-				prompt += "\n\nAdditional Context:\n" + extraContext.String()
-			}
-			return prompt
+			return prompt, entries
 		} else if strings.HasPrefix(line, ":context ") {
 			cmdStr := strings.TrimPrefix(line, ":context ")
 			if debugMode {
 				fmt.Fprintf(os.Stderr, "[DEBUG] Running context command: %s\n", cmdStr)
 			}
-			output, cerr := runShellCommand(cmdStr)
+			output, cerr := runContextCommand(cmdStr)
 			if cerr != nil {
 				fmt.Fprintf(os.Stderr, "Error adding context: %v\n", cerr)
 			} else {
-				fmt.Println(output)
-				extraContext.WriteString("\n---\nCommand: " + cmdStr + "\n" + output + "\n")
+				entries = append(entries, ContextEntry{Kind: "command", Source: cmdStr, Content: output, Time: time.Now()})
+			}
+		} else if strings.HasPrefix(line, ":attach ") {
+			attached, aerr := collectAttachments(strings.Fields(strings.TrimPrefix(line, ":attach ")))
+			if aerr != nil {
+				fmt.Fprintf(os.Stderr, "Error attaching files: %v\n", aerr)
+			} else {
+				entries = append(entries, attached...)
+				fmt.Fprintln(w, attachmentSummary(attached))
 			}
 		} else if line == ":edit" {
 			edited, err := openEditor(prompt)
@@ -484,82 +907,158 @@ func runInitialContextLoop(initialPrompt string) string {
 				prompt = edited
 			}
 		} else {
-			fmt.Println("Unknown command. Available: :context <cmd>, :edit, :done")
+			fmt.Fprintln(w, "Unknown command. Available: :context <cmd>, :attach <path>, :edit, :done")
 		}
 	}
 }
 
-func handleRefine(args []string) {
-	lastPrompt, lastResponse, lastSessionPath, err := getLastSession()
+// handleRefine continues the session identified by sessionRef, or the most
+// recent session if sessionRef is empty.
+func handleRefine(sessionRef string, args []string, attach []string) {
+	if sessionRef == "" {
+		sessionRef = "last"
+	}
+	parent, err := resolveSession(sessionRef)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error retrieving last session: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error retrieving session: %v\n", err)
 		os.Exit(1)
 	}
 
-	originalPrompt, _ := ioutil.ReadFile(filepath.Join(lastSessionPath, "original_prompt.txt"))
-	if len(originalPrompt) == 0 {
-		originalPrompt = []byte(lastPrompt)
-	}
-
-	runOutput := readFileIfExists(filepath.Join(lastSessionPath, "run_output.txt"))
-	contextOutput := readFileIfExists(filepath.Join(lastSessionPath, "context.txt"))
+	runOutput := formatRuns(parent.Runs)
+	contextOutput := formatContext(parent.pendingContext())
 
 	refinement := ""
-	if len(args) > 0 {
-		refinement = strings.Join(args, " ")
-	} else {
-		initialRefine := "Provide refinement/context below:\n\n---\nPrevious Response:\n" + lastResponse
-		if runOutput != "" {
-			initialRefine += "\n\nRun Output:\n" + runOutput
-		}
-		if contextOutput != "" {
-			initialRefine += "\n\nAdditional Context:\n" + contextOutput
+	extra, err := collectAttachments(attach)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error attaching files: %v\n", err)
+		os.Exit(1)
+	}
+	if stdinHasInput() {
+		data := readPipedStdin()
+		if len(args) == 0 {
+			refinement = strings.TrimSpace(data)
+			if refinement == "" {
+				fmt.Fprintln(os.Stderr, "No refinement provided.")
+				os.Exit(1)
+			}
+		} else if strings.TrimSpace(data) != "" {
+			extra = append(extra, stdinContext(data))
 		}
-		initialRefine += "\n\nOriginal Prompt:\n" + string(originalPrompt)
+	}
 
-		edited, err := openEditor(initialRefine)
+	if len(args) > 0 {
+		refinement = strings.Join(args, " ")
+	} else if refinement == "" {
+		edited, err := openEditor(refinementTemplate(parent.Answer(), runOutput, contextOutput))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Failed to open editor: %v\n", err)
 			os.Exit(1)
 		}
-		refinement = edited
+		refinement = stripScissors(edited)
 	}
 
-	finalPrompt := "Refine the following response with the additional context:\n\nORIGINAL PROMPT:\n" + string(originalPrompt) +
-		"\n\nPREVIOUS PROMPT:\n" + lastPrompt +
-		"\n\nPREVIOUS RESPONSE:\n" + lastResponse
-
-	if runOutput != "" {
-		finalPrompt += "\n\nPREVIOUS COMMAND RUN OUTPUT:\n" + runOutput
+	ctx, stop := interruptContext()
+	session, err := refineSession(ctx, parent, refinement, extra, answerOutput())
+	stop()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting refinement: %v\n", err)
+		os.Exit(1)
 	}
-	if contextOutput != "" {
-		finalPrompt += "\n\nADDITIONAL CONTEXT:\n" + contextOutput
+	if outputFormat != outputText {
+		printAnswerResult(session)
+		if session.Interrupted {
+			os.Exit(1)
+		}
+		return
+	}
+	if session.Interrupted {
+		fmt.Fprintf(os.Stderr, "Partial refined session stored in: %s\n", session.Dir())
+		os.Exit(1)
 	}
-	finalPrompt += "\n\nREFINEMENT CONTEXT:\n" + refinement
+	fmt.Fprintf(os.Stderr, "Refined session stored in: %s\n", session.Dir())
+}
 
+// refineSession asks the model to refine parent with the given request and
+// extra context, streaming the answer to out, and stores the result as a
+// new session. Earlier turns are kept intact; the new turn is fitted into
+// what's left of the budget.
+func refineSession(ctx context.Context, parent *Session, refinement string, extra []ContextEntry, out io.Writer) (*Session, error) {
+	turn, trimmed := budgetRefinement(parent, refinement, extra)
 	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Refine finalPrompt:\n%s\n", finalPrompt)
+		fmt.Fprintf(os.Stderr, "[DEBUG] Refine turn:\n%s\n", turn)
+	}
+	session := newSession(appendMessage(parent.Messages, openai.ChatMessageRoleUser, turn), parent)
+	session.ContextTrimmed = trimmed
+	for _, e := range extra {
+		e.Included = true
+		session.Context = append(session.Context, e)
+	}
+	if _, err := answerSessionContext(ctx, session, out); err != nil {
+		return nil, err
 	}
+	if err := createSession(session); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
+	}
+	return session, nil
+}
 
-	// Token limit check again (in refinement)
-	maxChars := maxTokens * charsPerToken
-	if len(finalPrompt) > maxChars {
-		finalPrompt = finalPrompt[:maxChars]
+// refinementTemplate is the initial editor content for a refinement. The
+// user writes above the scissors line; everything below is for reference.
+func refinementTemplate(previousResponse, runOutput, contextOutput string) string {
+	template := "\n\n" + scissorsLine + "\nWrite your refinement above this line. Everything below it is for reference only.\n\n---\nPrevious Response:\n" + previousResponse
+	if runOutput != "" {
+		template += "\n\nRun Output (will be sent):\n" + runOutput
+	}
+	if contextOutput != "" {
+		template += "\n\nAdditional Context (will be sent):\n" + contextOutput
 	}
+	return template
+}
 
-	answer, err := askChatGPT(finalPrompt)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting refinement: %v\n", err)
-		os.Exit(1)
+func stripScissors(text string) string {
+	if i := strings.Index(text, scissorsLine); i > -1 {
+		text = text[:i]
 	}
+	return strings.TrimSpace(text)
+}
 
-	sessionPath, err := storeSession(finalPrompt, answer, string(originalPrompt))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
+// refinementTurn builds the user message for a refinement. Output gathered
+// since the previous answer is included so the model sees what happened.
+func refinementTurn(refinement, runOutput, contextOutput string) string {
+	var turn strings.Builder
+	if runOutput != "" {
+		turn.WriteString("Output of running the suggested command:\n" + strings.TrimRight(runOutput, "\n") + "\n\n")
+	}
+	if contextOutput != "" {
+		turn.WriteString("Additional Context:\n" + strings.TrimRight(contextOutput, "\n") + "\n\n")
 	}
+	turn.WriteString(refinement)
+	return strings.TrimSpace(turn.String())
+}
+
+// budgetRefinement builds the refinement turn for s, trimming run output and
+// context to fit the prompt budget and reporting what was cut, and whether
+// anything was. extra is context that arrived with the refinement itself;
+// its entries are marked if they had to be trimmed.
+func budgetRefinement(s *Session, refinement string, extra []ContextEntry) (string, bool) {
+	runs := runItems(s.Runs)
+	items := append(runs, contextItems(append(s.pendingContext(), extra...))...)
+	turn, kept, report := budgetTurn(s.Messages, refinement, items, func(question string, kept []string) string {
+		return refinementTurn(question, strings.Join(kept[:len(runs)], ""), strings.Join(kept[len(runs):], ""))
+	})
+	report.Print(os.Stderr)
+	markTrimmed(extra, kept[len(kept)-len(extra):])
+	return turn, report.Trimmed()
+}
 
-	fmt.Println(answer)
-	fmt.Fprintf(os.Stderr, "Refined session stored in: %s\n", sessionPath)
+// askLayout appends the context entries to the question of a new
+// conversation.
+func askLayout(question string, kept []string) string {
+	context := strings.Join(kept, "")
+	if context == "" {
+		return question
+	}
+	return question + "\n\nAdditional Context:\n" + context
 }
 
 func handleInteractive(args []string) {
@@ -572,14 +1071,15 @@ func handleInteractive(args []string) {
 		return
 	}
 	defer rl.Close()
+	surviveInterrupts()
 
 	fmt.Println("Entering interactive mode. Type 'help' for commands, 'exit' to quit.")
+	fmt.Println("Ctrl+C cancels a running request or command.")
 
 	var currentPrompt string
 	var currentAnswer string
-	var currentSessionPath string
-	var originalPrompt string
-	var pendingContext strings.Builder
+	var currentSession *Session
+	var pendingContext []ContextEntry
 
 	// currentCommands holds all extracted commands from the current answer
 	var currentCommands []string
@@ -589,7 +1089,8 @@ func handleInteractive(args []string) {
 		if err != nil && err == io.EOF {
 			break
 		} else if err == readline.ErrInterrupt {
-			break
+			fmt.Println("Type 'exit' or press Ctrl+D to quit.")
+			continue
 		}
 
 		line = strings.TrimSpace(line)
@@ -605,9 +1106,14 @@ func handleInteractive(args []string) {
 			fmt.Println("  refine           : Refine the current answer with additional context")
 			fmt.Println("  run              : List available commands extracted from the current answer")
 			fmt.Println("  run <N>          : Run the Nth command (1-based) from the extracted commands")
+			fmt.Println("  autofix [N]      : Run the first command and, while it fails, ask for a fix (up to N times, default 3)")
+			fmt.Println("  sandbox [on|off] : Show or set whether commands run in a sandbox")
+			fmt.Println("  pty [on|off]     : Show or set whether commands run on a terminal (for interactive programs)")
 			fmt.Println("  context          : Prompt for a command to add context")
 			fmt.Println("  context <cmd>    : Run <cmd> and add output as context immediately")
+			fmt.Println("  attach <path>... : Attach files, directories or globs as context")
 			fmt.Println("  show             : Show current prompt and answer")
+			fmt.Println("  load <id>        : Load a stored session (ID, prefix, or 'last') to continue it")
 			fmt.Println("  exit             : Quit")
 
 		case line == "prompt":
@@ -629,29 +1135,31 @@ func handleInteractive(args []string) {
 				if debugMode {
 					fmt.Fprintf(os.Stderr, "[DEBUG] Asking prompt:\n%s\n", currentPrompt)
 				}
-				if pendingContext.Len() > 0 {
-					currentPrompt += "\n\nAdditional Context:\n" + pendingContext.String()
-					pendingContext.Reset()
-				}
-
-				maxChars := maxTokens * charsPerToken
-				if len(currentPrompt) > maxChars {
-					currentPrompt = currentPrompt[:maxChars]
+				turn, kept, report := budgetTurn(nil, currentPrompt, contextItems(pendingContext), askLayout)
+				report.Print(os.Stderr)
+				markTrimmed(pendingContext, kept)
+
+				// A new prompt starts a new conversation.
+				session := newSession([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: turn}}, nil)
+				session.ContextTrimmed = report.Trimmed()
+				for _, e := range pendingContext {
+					e.Included = true
+					session.Context = append(session.Context, e)
 				}
+				pendingContext = nil
 
-				ans, err := askChatGPT(currentPrompt)
+				fmt.Println("Answer:")
+				ans, err := answerSession(session, os.Stdout)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 					continue
 				}
 				currentAnswer = ans
-				if originalPrompt == "" {
-					originalPrompt = currentPrompt
+				if err := createSession(session); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
 				}
-				sessionPath, _ := storeSession(currentPrompt, currentAnswer, originalPrompt)
-				currentSessionPath = sessionPath
-				fmt.Println("Answer:\n", currentAnswer)
-				fmt.Fprintf(os.Stderr, "Session stored at: %s\n", sessionPath)
+				currentSession = session
+				fmt.Fprintf(os.Stderr, "Session stored at: %s\n", session.Dir())
 
 				// Extract all commands from currentAnswer
 				currentCommands = extractCommands(currentAnswer)
@@ -670,69 +1178,60 @@ func handleInteractive(args []string) {
 					continue
 				}
 
-				// Load previous session outputs if available
-				var runOutput, contextOutput string
-				if currentSessionPath != "" {
-					runOutput = readFileIfExists(filepath.Join(currentSessionPath, "run_output.txt"))
-					contextOutput = readFileIfExists(filepath.Join(currentSessionPath, "context.txt"))
-					orig, err := ioutil.ReadFile(filepath.Join(currentSessionPath, "original_prompt.txt"))
-					if err == nil && len(orig) > 0 {
-						originalPrompt = string(orig)
-					}
-				}
+				// Include what was run or added since the answer
+				runOutput := formatRuns(currentSession.Runs)
+				contextOutput := formatContext(currentSession.pendingContext())
 
-				initialRefine := "Refine this answer with the following context:\n\n---\nCurrent Answer:\n" + currentAnswer
-				if runOutput != "" {
-					initialRefine += "\n\nRun Output:\n" + runOutput
-				}
-				if contextOutput != "" {
-					initialRefine += "\n\nAdditional Context:\n" + contextOutput
-				}
-				if originalPrompt != "" {
-					initialRefine += "\n\nOriginal Prompt:\n" + originalPrompt
-				}
-
-				refineEditor, err := openEditor(initialRefine)
+				refineEditor, err := openEditor(refinementTemplate(currentAnswer, runOutput, contextOutput))
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 					continue
 				}
-				finalPrompt := "Refine this answer with the following context:\nORIGINAL PROMPT:\n" + originalPrompt +
-					"\nANSWER:\n" + currentAnswer
-				if runOutput != "" {
-					finalPrompt += "\nRUN OUTPUT:\n" + runOutput
-				}
-				if contextOutput != "" {
-					finalPrompt += "\nADDITIONAL CONTEXT:\n" + contextOutput
-				}
-				finalPrompt += "\nREFINEMENT:\n" + refineEditor
+				turn, trimmed := budgetRefinement(currentSession, stripScissors(refineEditor), nil)
 				if debugMode {
-					fmt.Fprintf(os.Stderr, "[DEBUG] Refinement \n%s\n", refineEditor)
+					fmt.Fprintf(os.Stderr, "[DEBUG] Refine turn:\n%s\n", turn)
 				}
+				session := newSession(appendMessage(currentSession.Messages, openai.ChatMessageRoleUser, turn), currentSession)
+				session.ContextTrimmed = trimmed
 
-				if debugMode {
-					fmt.Fprintf(os.Stderr, "[DEBUG] Refine finalPrompt:\n%s\n", finalPrompt)
-				}
-
-				maxChars := maxTokens * charsPerToken
-				if len(finalPrompt) > maxChars {
-					finalPrompt = finalPrompt[:maxChars]
-				}
-
-				ans, err := askChatGPT(finalPrompt)
+				fmt.Println("Refined Answer:")
+				ans, err := answerSession(session, os.Stdout)
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 					continue
 				}
 				currentAnswer = ans
-				sessionPath, _ := storeSession(finalPrompt, currentAnswer, originalPrompt)
-				currentSessionPath = sessionPath
-				fmt.Println("Refined Answer:\n", currentAnswer)
-				fmt.Fprintf(os.Stderr, "Refined session stored at: %s\n", sessionPath)
+				if err := createSession(session); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
+				}
+				currentSession = session
+				fmt.Fprintf(os.Stderr, "Refined session stored at: %s\n", session.Dir())
 
 				// Extract commands again after refinement if needed
 				currentCommands = extractCommands(currentAnswer)
 
+			} else if line == "autofix" || strings.HasPrefix(line, "autofix ") {
+				attempts := defaultFixAttempts
+				if arg := strings.TrimSpace(strings.TrimPrefix(line, "autofix")); arg != "" {
+					n, err := strconv.Atoi(arg)
+					if err != nil || n < 1 {
+						fmt.Println("Usage: autofix [N]")
+						continue
+					}
+					attempts = n
+				}
+				if len(currentCommands) == 0 {
+					fmt.Println("No commands available to run.")
+					continue
+				}
+				last, _ := fixLoop(currentSession, currentCommands[0], attempts)
+				if last != currentSession {
+					currentSession = last
+					currentAnswer = last.Answer()
+					currentCommands = extractCommands(currentAnswer)
+					fmt.Fprintf(os.Stderr, "Refined session stored at: %s\n", last.Dir())
+				}
+
 			} else if strings.HasPrefix(line, "run") {
 				parts := strings.Split(line, " ")
 				if len(parts) == 1 {
@@ -758,11 +1257,7 @@ func handleInteractive(args []string) {
 						continue
 					}
 					cmdStr := currentCommands[n-1]
-					if currentSessionPath == "" {
-						sessionPath, _ := storeSession(currentPrompt, currentAnswer, originalPrompt)
-						currentSessionPath = sessionPath
-					}
-					if err := runCommandInteractively(cmdStr, currentSessionPath); err != nil {
+					if err := runCommandInteractively(cmdStr, currentSession); err != nil {
 						fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
 					}
 				}
@@ -777,14 +1272,75 @@ func handleInteractive(args []string) {
 				if ctxLine == "" {
 					continue
 				}
-				addContextInInteractive(ctxLine, currentSessionPath, &pendingContext)
+				addContextInInteractive(ctxLine, currentSession, &pendingContext)
 
 			} else if strings.HasPrefix(line, "context ") {
 				cmdStr := strings.TrimPrefix(line, "context ")
-				addContextInInteractive(cmdStr, currentSessionPath, &pendingContext)
+				addContextInInteractive(cmdStr, currentSession, &pendingContext)
+			} else if strings.HasPrefix(line, "attach ") {
+				attachInInteractive(strings.Fields(strings.TrimPrefix(line, "attach ")), currentSession, &pendingContext)
+			} else if line == "sandbox" || strings.HasPrefix(line, "sandbox ") {
+				switch strings.TrimSpace(strings.TrimPrefix(line, "sandbox")) {
+				case "on":
+					sandboxMode = true
+				case "off":
+					sandboxMode = false
+				case "":
+				default:
+					fmt.Println("Usage: sandbox [on|off]")
+					continue
+				}
+				if sandboxMode {
+					fmt.Println("Commands run in a sandbox.")
+				} else {
+					fmt.Println("Commands run directly in the working directory.")
+				}
+			} else if line == "pty" || strings.HasPrefix(line, "pty ") {
+				switch strings.TrimSpace(strings.TrimPrefix(line, "pty")) {
+				case "on":
+					ptyMode = true
+				case "off":
+					ptyMode = false
+				case "":
+				default:
+					fmt.Println("Usage: pty [on|off]")
+					continue
+				}
+				if ptyMode {
+					fmt.Println("Commands run on a terminal; their output is recorded as a transcript.")
+				} else {
+					fmt.Println("Commands run with their stdout and stderr captured separately.")
+				}
 			} else if line == "show" {
 				fmt.Println("Current Prompt:\n", currentPrompt)
 				fmt.Println("Current Answer:\n", currentAnswer)
+				if currentSession != nil {
+					if runs := formatRuns(currentSession.Runs); runs != "" {
+						fmt.Println("Run Output:", runs)
+					}
+					if ctx := formatContext(currentSession.pendingContext()); ctx != "" {
+						fmt.Println("Context:", ctx)
+					}
+				}
+			} else if strings.HasPrefix(line, "load ") {
+				ref := strings.TrimSpace(strings.TrimPrefix(line, "load "))
+				session, err := resolveSession(ref)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					continue
+				}
+				currentSession = session
+				currentPrompt = session.LastPrompt()
+				currentAnswer = session.Answer()
+				currentCommands = extractCommands(currentAnswer)
+				fmt.Printf("Loaded session %s (%d messages, %d runs, %d context entries).\n",
+					session.ID, len(session.Messages), len(session.Runs), len(session.Context))
+				fmt.Println("Answer:")
+				fmt.Println(currentAnswer)
+				if len(currentCommands) > 0 {
+					fmt.Printf("%d command(s) found. Type 'run' to list them.\n", len(currentCommands))
+				}
+				fmt.Println("Use 'refine' to continue this conversation, or 'show' to see run output and context.")
 			} else if line != "" {
 				fmt.Println("Unknown command. Type 'help' for usage.")
 			}
@@ -851,81 +1407,275 @@ func parseCommandLine(line string, inBlock bool) string {
 	}
 }
 
-func handleContext(args []string) {
+func handleContext(args []string, files bool) {
 	if len(args) == 0 {
 		fmt.Fprintln(os.Stderr, "No command provided for context.")
 		os.Exit(1)
 	}
 
+	if files {
+		entries, err := collectAttachments(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error attaching files: %v\n", err)
+			os.Exit(1)
+		}
+		session, err := addContextEntries(entries)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error adding context: %v\n", err)
+			os.Exit(1)
+		}
+		if session == nil {
+			fmt.Println(attachmentSummary(entries), "for future use (pending)")
+		} else {
+			fmt.Println(attachmentSummary(entries))
+		}
+		return
+	}
+
 	cmdStr := strings.Join(args, " ")
 
-	_, _, sessionPath, err := getLastSession()
+	session, err := getLastSession()
 	if err != nil {
 		// No session yet, store in pending context file
-		output, cmdErr := runShellCommand(cmdStr)
+		output, cmdErr := runContextCommand(cmdStr)
 		if cmdErr != nil {
 			fmt.Fprintf(os.Stderr, "Error adding context: %v\n", cmdErr)
-			fmt.Fprintln(os.Stderr, output)
 			os.Exit(1)
 		}
-		appendToPendingContext(cmdStr, output)
+		if err := appendToPendingContext(ContextEntry{Kind: "command", Source: cmdStr, Content: output, Time: time.Now()}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving pending context: %v\n", err)
+			os.Exit(1)
+		}
 		fmt.Println("Context added for future use (pending):", cmdStr)
 		return
 	}
 
-	if err := addContextCommand(cmdStr, sessionPath); err != nil {
+	if err := addContextCommand(cmdStr, session); err != nil {
 		fmt.Fprintf(os.Stderr, "Error adding context: %v\n", err)
 		os.Exit(1)
 	}
 	fmt.Println("Context added from command:", cmdStr)
 }
 
-func handleModels() {
-	client := openai.NewClient(apiKey)
-	ctx := context.Background()
+// addContextEntries adds entries to the last session, to be sent with its
+// next refinement, or keeps them for the next question if there is no
+// session yet. It returns the session they were added to, if any.
+func addContextEntries(entries []ContextEntry) (*Session, error) {
+	session, err := getLastSession()
+	if err != nil {
+		for _, e := range entries {
+			if err := appendToPendingContext(e); err != nil {
+				return nil, fmt.Errorf("saving pending context: %w", err)
+			}
+		}
+		return nil, nil
+	}
+	session.Context = append(session.Context, entries...)
+	return session, saveSession(session)
+}
 
-	resp, err := client.ListModels(ctx)
+func handleModels(registry bool) {
+	if registry {
+		if outputFormat != outputText {
+			printModelRecords(registeredModelIDs())
+			return
+		}
+		fmt.Println("Model Registry (built-in and configured):")
+		printModelTable(registeredModelIDs())
+		return
+	}
+
+	p, err := newProvider()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, apiTimeout)
+	defer cancel()
+
+	models, err := p.ListModels(ctx)
+	err = cancelError(ctx, err, apiTimeout)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error listing models: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Println("Available Models:")
-	for _, m := range resp.Models {
-		if m.ID == model {
-			fmt.Println("*", m.ID)
-		} else {
-			fmt.Println(m.ID)
+	if outputFormat != outputText {
+		printModelRecords(models)
+		return
+	}
+	fmt.Printf("Available Models (%s):\n", providerName)
+	printModelTable(models)
+}
+
+// printModelRecords lists models in the machine output formats.
+func printModelRecords(ids []string) {
+	var records []interface{}
+	for _, id := range ids {
+		info, known := lookupModel(id)
+		records = append(records, modelSummary{ID: id, Current: id == model, Known: known, ModelInfo: info})
+	}
+	printRecords(records)
+}
+
+// printModelTable lists models with their registry information. Models the
+// registry doesn't know are shown with the defaults ask assumes for them.
+func printModelTable(ids []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  MODEL\tCONTEXT\tOUTPUT\tTOKENIZER\tFEATURES")
+	for _, id := range ids {
+		info, known := lookupModel(id)
+		mark := "  "
+		if id == model {
+			mark = "* "
+		}
+		features := strings.Join(info.Features, ",")
+		if features == "" {
+			features = "-"
+		}
+		if !known {
+			features += " (unknown model, defaults)"
 		}
+		fmt.Fprintf(w, "%s%s\t%d\t%d\t%s\t%s\n", mark, id, info.ContextWindow, info.MaxOutputTokens, info.Tokenizer, features)
 	}
+	w.Flush()
 }
 
-func askChatGPT(prompt string) (string, error) {
+// askChatGPT sends the conversation to the configured provider and returns
+// the model's reply, which either answers or asks for the given tools to be
+// called, along with why it stopped and the tokens it used. A non-empty
+// instruction is appended to the system prompt. If out is
+// non-nil the answer is streamed to it as it arrives. The request gives up
+// after apiTimeout or when ctx is cancelled; whatever was streamed until
+// then is returned along with the error.
+func askChatGPT(ctx context.Context, messages []openai.ChatCompletionMessage, tools []openai.Tool, instruction string, out io.Writer) (openai.ChatCompletionChoice, openai.Usage, error) {
+	var reply openai.ChatCompletionChoice
+	info, known := lookupModel(model)
 	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Sending prompt to ChatGPT using model '%s' (max_tokens=%d):\n%s\n", model, maxTokens, prompt)
+		fmt.Fprintf(os.Stderr, "[DEBUG] Sending %d messages to %s using model '%s' (known=%t, context=%d, features=%s):\n%s\n", len(messages), providerName, model, known, info.ContextWindow, strings.Join(info.Features, ","), messages[len(messages)-1].Content)
 	}
-	client := openai.NewClient(apiKey)
-	ctx := context.Background()
+	p, err := cachedProvider()
+	if err != nil {
+		return reply, openai.Usage{}, err
+	}
+	ctx, cancel := withTimeout(ctx, apiTimeout)
+	defer cancel()
 
 	systemMessage := "You are a helpful assistant. The user might ask about commands or actions as if you could run them, but you cannot. " +
 		"Do not refuse by stating inability to execute commands. Instead, provide instructions, examples, or guidance as if the user will run them themselves."
+	if instruction != "" {
+		systemMessage += " " + instruction
+	}
 
-	resp, err := client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
-		Model: model,
-		Messages: []openai.ChatCompletionMessage{
-			{Role: openai.ChatMessageRoleSystem, Content: systemMessage},
-			{Role: openai.ChatMessageRoleUser, Content: prompt},
-		},
-	})
+	req := openai.ChatCompletionRequest{
+		Model:    model,
+		Messages: withSystemMessage(info, systemMessage, messages),
+		Tools:    tools,
+	}
+
+	var resp openai.ChatCompletionResponse
+	var streamed strings.Builder
+	if info.Supports(featureStreaming) {
+		resp, err = p.CreateChatCompletionStream(ctx, req, func(delta string) {
+			streamed.WriteString(delta)
+			if out != nil {
+				io.WriteString(out, delta)
+			}
+		})
+		if out != nil && streamed.Len() > 0 && !strings.HasSuffix(streamed.String(), "\n") {
+			fmt.Fprintln(out)
+		}
+	} else {
+		resp, err = p.CreateChatCompletion(ctx, req)
+		if err == nil && out != nil && len(resp.Choices) > 0 {
+			fmt.Fprintln(out, strings.TrimRight(resp.Choices[0].Message.Content, "\n"))
+		}
+	}
 	if err != nil {
-		return "", err
+		err = cancelError(ctx, err, apiTimeout)
+		if ctx.Err() != nil && streamed.Len() > 0 {
+			reply.Message = openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: strings.TrimSpace(streamed.String())}
+		}
+		return reply, openai.Usage{}, err
 	}
 
-	if len(resp.Choices) == 0 {
-		return "", errors.New("no response from model")
+	if len(resp.Choices) == 0 || (resp.Choices[0].Message.Content == "" && len(resp.Choices[0].Message.ToolCalls) == 0) {
+		return reply, openai.Usage{}, errors.New("no response from model")
 	}
 
-	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+	reply = resp.Choices[0]
+	reply.Message.Role = openai.ChatMessageRoleAssistant
+	reply.Message.Content = strings.TrimSpace(reply.Message.Content)
+	return reply, resp.Usage, nil
+}
+
+// answerSession asks for the next answer in session and appends it, with
+// Ctrl+C cancelling the request. See answerSessionContext.
+func answerSession(session *Session, out io.Writer) (string, error) {
+	ctx, stop := interruptContext()
+	defer stop()
+	return answerSessionContext(ctx, session, out)
+}
+
+// answerSessionContext asks for the next answer in session and appends it.
+// When the model calls tools, they are run (see tools.go) and their results
+// sent back until it answers. An answer cut short by ctx ending or a
+// timeout is kept and the session marked as interrupted, so only an empty
+// answer is an error.
+func answerSessionContext(ctx context.Context, session *Session, out io.Writer) (string, error) {
+	tools := sessionTools()
+	for round := 1; ; round++ {
+		if round > maxToolRounds && tools != nil {
+			fmt.Fprintf(os.Stderr, "The model made %d rounds of tool calls; asking it to answer without tools.\n", maxToolRounds)
+			tools = nil
+		}
+		choice, usage, err := askChatGPT(ctx, session.Messages, tools, session.instruction, out)
+		reply := choice.Message
+		session.addUsage(usage)
+		if err != nil {
+			if reply.Content == "" {
+				return "", err
+			}
+			session.Interrupted = true
+			fmt.Fprintf(os.Stderr, "Answer cut short (%v); keeping what arrived.\n", err)
+			reply.ToolCalls = nil
+		}
+		if len(reply.ToolCalls) == 0 {
+			session.Truncated = choice.FinishReason == openai.FinishReasonLength
+			if session.Truncated {
+				fmt.Fprintln(os.Stderr, "The answer reached the output token limit and may be incomplete.")
+			}
+			session.Messages = appendMessage(session.Messages, openai.ChatMessageRoleAssistant, reply.Content)
+			return reply.Content, nil
+		}
+
+		// Record the request for tools and every result, so that later
+		// turns replay the whole exchange.
+		session.Messages = append(session.Messages, reply)
+		for _, call := range reply.ToolCalls {
+			result := callTool(ctx, session, call)
+			session.Messages = append(session.Messages, openai.ChatCompletionMessage{Role: openai.ChatMessageRoleTool, ToolCallID: call.ID, Content: result})
+		}
+	}
+}
+
+// withSystemMessage prepends the system prompt to messages. Models that
+// reject the system role get it folded into the first user message instead.
+func withSystemMessage(info ModelInfo, system string, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if info.Supports(featureSystemRole) {
+		return append([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleSystem, Content: system}}, messages...)
+	}
+	out := make([]openai.ChatCompletionMessage, len(messages))
+	copy(out, messages)
+	for i, m := range out {
+		if m.Role == openai.ChatMessageRoleUser {
+			out[i].Content = system + "\n\n" + m.Content
+			return out
+		}
+	}
+	return append([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: system}}, out...)
 }
 
 func openEditor(initialContent string) (string, error) {
@@ -947,9 +1697,20 @@ func openEditor(initialContent string) (string, error) {
 		fmt.Fprintf(os.Stderr, "[DEBUG] Opening editor: %s %s\n", editor, tmpfile.Name())
 	}
 
+	tty, closeTTY, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer closeTTY()
+
 	cmd := exec.Command(editor, tmpfile.Name())
-	cmd.Stdin = os.Stdin
+	cmd.Stdin = tty
+	// The editor draws on the terminal, which stdout may not be, as with -o
+	// or a redirect.
 	cmd.Stdout = os.Stdout
+	if stdoutIsPiped() {
+		cmd.Stdout = os.Stderr
+	}
 	cmd.Stderr = os.Stderr
 	err = cmd.Run()
 	if err != nil {
@@ -963,76 +1724,11 @@ func openEditor(initialContent string) (string, error) {
 	return string(data), nil
 }
 
-func storeSession(prompt, answer, originalPrompt string) (string, error) {
-	homedir, err := os.UserHomeDir()
-	if err != nil {
-		return "", err
-	}
-
-	sessionDir := filepath.Join(homedir, historyDirName)
-	err = os.MkdirAll(sessionDir, 0755)
-	if err != nil {
-		return "", err
-	}
-
-	timestamp := time.Now().Format("20060102-150405")
-	currentSessionPath := filepath.Join(sessionDir, timestamp)
-	err = os.Mkdir(currentSessionPath, 0755)
-	if err != nil {
-		return "", err
-	}
-
-	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Storing session in: %s\n", currentSessionPath)
-	}
-
-	err = ioutil.WriteFile(filepath.Join(currentSessionPath, "prompt.txt"), []byte(prompt), 0644)
-	if err != nil {
-		return "", err
-	}
-
-	err = ioutil.WriteFile(filepath.Join(currentSessionPath, "response.txt"), []byte(answer), 0644)
-	if err != nil {
-		return "", err
-	}
-
-	err = ioutil.WriteFile(filepath.Join(currentSessionPath, "original_prompt.txt"), []byte(originalPrompt), 0644)
-	if err != nil {
-		return "", err
-	}
-
-	return currentSessionPath, nil
-}
-
-func getLastSession() (string, string, string, error) {
-	homedir, err := os.UserHomeDir()
-	if err != nil {
-		return "", "", "", err
-	}
-
-	sessionDir := filepath.Join(homedir, historyDirName)
-	files, err := ioutil.ReadDir(sessionDir)
-	if err != nil || len(files) == 0 {
-		return "", "", "", errors.New("no previous sessions found")
-	}
-
-	latest := files[len(files)-1]
-	sessionPath := filepath.Join(sessionDir, latest.Name())
-
-	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Last session path: %s\n", sessionPath)
-	}
-
-	promptData, err := ioutil.ReadFile(filepath.Join(sessionPath, "prompt.txt"))
-	if err != nil {
-		return "", "", "", err
-	}
-	responseData, err := ioutil.ReadFile(filepath.Join(sessionPath, "response.txt"))
-	if err != nil {
-		return "", "", "", err
-	}
-
-	return string(promptData), string(responseData), sessionPath, nil
+func appendMessage(messages []openai.ChatCompletionMessage, role, content string) []openai.ChatCompletionMessage {
+	// Copy so that a child session never shares a backing array with its parent.
+	out := make([]openai.ChatCompletionMessage, len(messages), len(messages)+1)
+	copy(out, messages)
+	return append(out, openai.ChatCompletionMessage{Role: role, Content: content})
 }
 
 func extractCommand(answer string) string {
@@ -1078,103 +1774,215 @@ func extractCodeBlock(lines []string) string {
 	return ""
 }
 
-func runCommandInteractively(cmdStr, sessionPath string) error {
-	fmt.Printf("About to run: %s\nPress Enter to confirm or type 'edit' to modify. Ctrl+C to cancel.\n", cmdStr)
-	var input string
-	fmt.Scanln(&input)
-	if input == "edit" {
-		edited, err := openEditor(cmdStr)
-		if err != nil {
-			return fmt.Errorf("error opening editor: %w", err)
-		}
-		cmdStr = strings.TrimSpace(edited)
+func runCommandInteractively(cmdStr string, session *Session) error {
+	if !confirmCommand(&cmdStr) {
+		return nil
 	}
 
-	if cmdStr == "" {
-		fmt.Println("No command to run after editing.")
-		return nil
+	var sb *sandbox
+	if sandboxMode {
+		var err error
+		if sb, err = newSandbox(); err != nil {
+			return fmt.Errorf("cannot create sandbox: %w", err)
+		}
+		defer sb.cleanup()
 	}
 
 	if debugMode {
-		fmt.Fprintf(os.Stderr, "[DEBUG] Running shell command: sh -c \"%s\"\n", cmdStr)
+		fmt.Fprintf(os.Stderr, "[DEBUG] Running shell command: sh -c \"%s\" (sandboxed: %v, pty: %v)\n", cmdStr, sb != nil, ptyMode)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, commandTimeout)
+	defer cancel()
+	start := time.Now()
+	var res commandResult
+	var err error
+	if ptyMode {
+		res, err = runCommandPTY(shellCommand(ctx, cmdStr, sb))
+	} else {
+		res, err = runCommand(shellCommand(ctx, cmdStr, sb))
 	}
+	err = cancelError(ctx, err, commandTimeout)
+	stop()
 
-	output, err := runShellCommand(cmdStr)
+	run := newSessionRun(cmdStr, start, res, err)
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Command ended with %s\n", run.Status())
+	}
+	if sb != nil {
+		run.Sandbox = reviewSandbox(sb)
+	}
 
-	if output != "" {
-		ioutil.WriteFile(filepath.Join(sessionPath, "run_output.txt"), []byte(output), 0644)
+	if session != nil {
+		session.Runs = append(session.Runs, run)
+		if serr := saveSession(session); serr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not store run output: %v\n", serr)
+		}
 	}
 
 	if err != nil {
-		fmt.Fprintln(os.Stderr, output)
+		if status := run.Status(); status != "" {
+			return fmt.Errorf("command failed: %s", status)
+		}
 		return fmt.Errorf("command failed: %w", err)
 	}
+	return nil
+}
 
-	if output != "" {
-		fmt.Println(output)
-	}
+// newSessionRun records the result of running cmdStr. err is the error
+// from running it, after cancelError.
+func newSessionRun(cmdStr string, start time.Time, res commandResult, err error) SessionRun {
+	run := SessionRun{
+		Command:    cmdStr,
+		Output:     res.Stdout,
+		Stderr:     res.Stderr,
+		PTY:        res.PTY,
+		DurationMS: res.Duration.Milliseconds(),
+		Time:       start,
+	}
+	if res.ExitCode >= 0 {
+		code := res.ExitCode
+		run.ExitCode = &code
+	}
+	switch {
+	case errors.Is(err, errTimedOut):
+		// The run's duration is recorded on its own.
+		run.Error = errTimedOut.Error()
+	case err != nil && run.ExitCode == nil:
+		run.Error = err.Error()
+	}
+	return run
+}
 
-	return nil
+// confirmCommand shows the command with its risk assessment and asks the
+// user to confirm it. Commands at or above the configured confirm level
+// must be confirmed by typing "yes". The user may edit the command first, in
+// which case it is assessed again.
+func confirmCommand(cmdStr *string) bool {
+	for {
+		if *cmdStr == "" {
+			fmt.Println("No command to run after editing.")
+			return false
+		}
+		assessment := assessCommand(*cmdStr)
+		if debugMode {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Risk assessment: %s, %d finding(s)\n", assessment.Level, len(assessment.Findings))
+		}
+
+		if sandboxMode {
+			fmt.Printf("About to run in a sandbox: %s\n", *cmdStr)
+		} else {
+			fmt.Printf("About to run: %s\n", *cmdStr)
+		}
+		printRiskBanner(assessment)
+		typed := confirmLevel() != riskNone && assessment.Level >= confirmLevel()
+		if typed {
+			fmt.Println("Type 'yes' to run it, 'edit' to modify it, or anything else to cancel.")
+		} else {
+			fmt.Println("Press Enter to run it, type 'edit' to modify it, or anything else to cancel.")
+		}
+
+		input, err := readTerminalLine()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot confirm command: %v\n", err)
+			return false
+		}
+		switch {
+		case input == "edit":
+			edited, err := openEditor(*cmdStr)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error opening editor: %v\n", err)
+				return false
+			}
+			*cmdStr = strings.TrimSpace(edited)
+		case typed && input == "yes":
+			return true
+		case !typed && (input == "" || input == "y" || input == "yes"):
+			return true
+		default:
+			fmt.Println("Cancelled.")
+			return false
+		}
+	}
 }
 
-func addContextCommand(cmdStr, sessionPath string) error {
+func addContextCommand(cmdStr string, session *Session) error {
 	if debugMode {
 		fmt.Fprintf(os.Stderr, "[DEBUG] Running context command: sh -c \"%s\"\n", cmdStr)
 	}
-	output, err := runShellCommand(cmdStr)
+	output, err := runContextCommand(cmdStr)
 
-	contextPath := filepath.Join(sessionPath, "context.txt")
-	f, ferr := os.OpenFile(contextPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if ferr != nil {
-		return ferr
+	session.Context = append(session.Context, ContextEntry{Kind: "command", Source: cmdStr, Content: output, Time: time.Now()})
+	if serr := saveSession(session); serr != nil {
+		return serr
 	}
-	defer f.Close()
-
-	f.WriteString("\n---\nCommand: " + cmdStr + "\n" + output + "\n")
 
 	if err != nil {
-		fmt.Fprintln(os.Stderr, output)
 		return fmt.Errorf("command failed: %w", err)
 	}
-
-	fmt.Println(output)
 	return nil
 }
 
-func addContextInInteractive(cmdStr string, currentSessionPath string, pendingContext *strings.Builder) {
-	output, err := runShellCommand(cmdStr)
+func addContextInInteractive(cmdStr string, currentSession *Session, pendingContext *[]ContextEntry) {
+	output, err := runContextCommand(cmdStr)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error adding context: %v\n", err)
-		fmt.Fprintln(os.Stderr, output)
 		return
 	}
-	fmt.Println(output)
 
-	if currentSessionPath != "" {
-		contextPath := filepath.Join(currentSessionPath, "context.txt")
-		f, ferr := os.OpenFile(contextPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if ferr != nil {
-			fmt.Fprintf(os.Stderr, "Error writing context: %v\n", ferr)
+	entry := ContextEntry{Kind: "command", Source: cmdStr, Content: output, Time: time.Now()}
+	if currentSession != nil {
+		currentSession.Context = append(currentSession.Context, entry)
+		if err := saveSession(currentSession); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing context: %v\n", err)
+		}
+	} else {
+		*pendingContext = append(*pendingContext, entry)
+	}
+}
+
+// attachInInteractive attaches files to the current session, or keeps them
+// for the next prompt if there is none yet.
+func attachInInteractive(paths []string, currentSession *Session, pendingContext *[]ContextEntry) {
+	entries, err := collectAttachments(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error attaching files: %v\n", err)
+		return
+	}
+	if currentSession != nil {
+		currentSession.Context = append(currentSession.Context, entries...)
+		if err := saveSession(currentSession); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing context: %v\n", err)
 			return
 		}
-		defer f.Close()
-		f.WriteString("\n---\nCommand: " + cmdStr + "\n" + output + "\n")
 	} else {
-		pendingContext.WriteString("\n---\nCommand: " + cmdStr + "\n" + output + "\n")
+		*pendingContext = append(*pendingContext, entries...)
 	}
+	fmt.Println(attachmentSummary(entries))
 }
 
-func loadPendingContext() string {
+// loadPendingContext returns context gathered with `ask context` before any
+// session existed. The old plain-text file is still read if present.
+func loadPendingContext() []ContextEntry {
 	homedir, err := os.UserHomeDir()
 	if err != nil {
-		return ""
+		return nil
 	}
-	path := filepath.Join(homedir, pendingContextFile)
-	data, err := ioutil.ReadFile(path)
+	var entries []ContextEntry
+	if legacy := readFileIfExists(filepath.Join(homedir, legacyPendingContextFile)); legacy != "" {
+		entries = append(entries, ContextEntry{Kind: "legacy", Content: legacy})
+	}
+	data, err := ioutil.ReadFile(filepath.Join(homedir, pendingContextFile))
 	if err == nil && len(data) > 0 {
-		return string(data)
+		var stored []ContextEntry
+		if err := json.Unmarshal(data, &stored); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not read pending context: %v\n", err)
+		}
+		entries = append(entries, stored...)
 	}
-	return ""
+	return entries
 }
 
 func clearPendingContext() {
@@ -1182,32 +1990,31 @@ func clearPendingContext() {
 	if err != nil {
 		return
 	}
-	path := filepath.Join(homedir, pendingContextFile)
-	os.Remove(path)
+	os.Remove(filepath.Join(homedir, pendingContextFile))
+	os.Remove(filepath.Join(homedir, legacyPendingContextFile))
 }
 
-func appendToPendingContext(cmdStr, output string) {
+func appendToPendingContext(entry ContextEntry) error {
 	homedir, err := os.UserHomeDir()
 	if err != nil {
-		return
+		return err
 	}
 	path := filepath.Join(homedir, pendingContextFile)
-	f, ferr := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if ferr != nil {
-		return
+	var entries []ContextEntry
+	if data, err := ioutil.ReadFile(path); err == nil && len(data) > 0 {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
-	f.WriteString("\n---\nCommand: " + cmdStr + "\n" + output + "\n")
-}
-
-func runShellCommand(cmdStr string) (string, error) {
-	cmd := exec.Command("sh", "-c", cmdStr)
-	var outBuf, errBuf bytes.Buffer
-	cmd.Stdout = &outBuf
-	cmd.Stderr = &errBuf
-	err := cmd.Run()
-	output := outBuf.String() + errBuf.String()
-	return output, err
+	entries = append(entries, entry)
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
 }
 
 func readFileIfExists(path string) string {
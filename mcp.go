@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MCPServer is a Model Context Protocol server that ask starts and talks to
+// over stdio.
+type MCPServer struct {
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// mcpServers are the servers from the config, by name.
+var mcpServers map[string]MCPServer
+
+// mcpProtocolVersion is the protocol revision ask speaks.
+const mcpProtocolVersion = "2024-11-05"
+
+// mcpStartTimeout bounds how long a server may take to start and list its
+// tools.
+const mcpStartTimeout = 30 * time.Second
+
+// mcpToolSeparator joins a server's name and the name of one of its tools
+// into the name the model sees, e.g. "jira__search".
+const mcpToolSeparator = "__"
+
+var (
+	mcpOnce  sync.Once
+	mcpTools []tool
+)
+
+// startMCPTools starts the configured servers the first time tools are
+// needed and returns the tools they offer. A server that can't be started
+// is reported and left out. The servers run until ask exits; they see
+// their stdin close then.
+func startMCPTools() []tool {
+	mcpOnce.Do(func() {
+		names := make([]string, 0, len(mcpServers))
+		for name := range mcpServers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tools, err := startMCPServer(name, mcpServers[name])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: MCP server %s is not available: %v\n", name, err)
+				continue
+			}
+			if debugMode {
+				fmt.Fprintf(os.Stderr, "[DEBUG] MCP server %s offers %d tool(s)\n", name, len(tools))
+			}
+			mcpTools = append(mcpTools, tools...)
+		}
+	})
+	return mcpTools
+}
+
+// mcpToolInfo is a tool as listed by a server.
+type mcpToolInfo struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"inputSchema,omitempty"`
+}
+
+// startMCPServer starts one server, initializes it and lists its tools.
+func startMCPServer(name string, server MCPServer) ([]tool, error) {
+	if server.Command == "" {
+		return nil, errors.New("no command configured")
+	}
+	client, err := newMCPClient(server)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mcpStartTimeout)
+	defer cancel()
+	infos, err := client.start(ctx)
+	if err != nil {
+		client.close()
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("no answer after %v", mcpStartTimeout)
+		}
+		return nil, err
+	}
+
+	var tools []tool
+	for _, info := range infos {
+		info := info
+		params := info.InputSchema
+		if len(params) == 0 || string(params) == "null" {
+			params = json.RawMessage(`{"type": "object", "properties": {}}`)
+		}
+		tools = append(tools, tool{
+			Name:        mcpToolName(name, info.Name),
+			Description: info.Description,
+			Parameters:  params,
+			Policy:      toolAsk,
+			Run: func(ctx context.Context, args json.RawMessage) (string, error) {
+				return client.callTool(ctx, info.Name, args)
+			},
+		})
+	}
+	return tools, nil
+}
+
+var invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mcpToolName names a server's tool for the model. Characters tool names
+// can't contain are replaced.
+func mcpToolName(server, name string) string {
+	return invalidToolNameChars.ReplaceAllString(server+mcpToolSeparator+name, "_")
+}
+
+// mcpClient is a connection to a running server. Messages are JSON-RPC, one
+// per line on the server's stdin and stdout.
+type mcpClient struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	cancel context.CancelFunc
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]chan rpcMessage
+
+	// done is closed when the server's stdout ends; err says why.
+	done chan struct{}
+	err  error
+}
+
+func newMCPClient(server MCPServer) (*mcpClient, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, server.Command, server.Args...)
+	// Its own process group keeps Ctrl+C, meant for ask, from reaching it.
+	setProcessGroup(cmd)
+	if len(server.Env) > 0 {
+		cmd.Env = os.Environ()
+		for k, v := range server.Env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+	}
+	if debugMode {
+		cmd.Stderr = os.Stderr
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+	c := &mcpClient{cmd: cmd, stdin: stdin, cancel: cancel, pending: map[int]chan rpcMessage{}, done: make(chan struct{})}
+	go c.readLoop(stdout)
+	return c, nil
+}
+
+// start performs the initialization handshake and lists the server's
+// tools.
+func (c *mcpClient) start(ctx context.Context) ([]mcpToolInfo, error) {
+	init := map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "ask", "version": "1.0"},
+	}
+	var initResult struct {
+		Capabilities struct {
+			Tools *json.RawMessage `json:"tools"`
+		} `json:"capabilities"`
+	}
+	if err := c.call(ctx, "initialize", init, &initResult); err != nil {
+		return nil, fmt.Errorf("initialize: %w", err)
+	}
+	if err := c.notify("notifications/initialized", nil); err != nil {
+		return nil, err
+	}
+	if initResult.Capabilities.Tools == nil {
+		return nil, nil
+	}
+
+	var tools []mcpToolInfo
+	cursor := ""
+	for {
+		params := map[string]interface{}{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page struct {
+			Tools      []mcpToolInfo `json:"tools"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", params, &page); err != nil {
+			return nil, fmt.Errorf("tools/list: %w", err)
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// callTool calls one of the server's tools. A result the server flags as an
+// error is returned together with an error, so that the model sees both.
+func (c *mcpClient) callTool(ctx context.Context, name string, args json.RawMessage) (string, error) {
+	ctx, cancel := withTimeout(ctx, commandTimeout)
+	defer cancel()
+	var result struct {
+		Content []struct {
+			Type     string `json:"type"`
+			Text     string `json:"text"`
+			Resource *struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"resource"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+	var arguments map[string]interface{}
+	if err := decodeToolArgs(args, &arguments); err != nil {
+		return "", err
+	}
+	params := map[string]interface{}{"name": name, "arguments": arguments}
+	if err := c.call(ctx, "tools/call", params, &result); err != nil {
+		return "", cancelError(ctx, err, commandTimeout)
+	}
+
+	var parts []string
+	for _, content := range result.Content {
+		switch {
+		case content.Type == "text":
+			parts = append(parts, content.Text)
+		case content.Type == "resource" && content.Resource != nil && content.Resource.Text != "":
+			parts = append(parts, content.Resource.URI+":\n"+content.Resource.Text)
+		default:
+			parts = append(parts, fmt.Sprintf("[%s content omitted]", content.Type))
+		}
+	}
+	out := strings.Join(parts, "\n")
+	if result.IsError {
+		return out, errors.New("the tool reported an error")
+	}
+	return out, nil
+}
+
+// call sends a request and decodes its result into result. If ctx ends
+// first, the server is told to cancel the request.
+func (c *mcpClient) call(ctx context.Context, method string, params, result interface{}) error {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	ch := make(chan rpcMessage, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	msg := rpcMessage{JSONRPC: "2.0", ID: json.RawMessage(strconv.Itoa(id)), Method: method, Params: raw}
+	if err := c.send(msg); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil || len(resp.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	case <-ctx.Done():
+		c.notify("notifications/cancelled", map[string]interface{}{"requestId": id, "reason": ctx.Err().Error()})
+		return ctx.Err()
+	case <-c.done:
+		return c.err
+	}
+}
+
+func (c *mcpClient) notify(method string, params interface{}) error {
+	msg := rpcMessage{JSONRPC: "2.0", Method: method}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		msg.Params = raw
+	}
+	return c.send(msg)
+}
+
+func (c *mcpClient) send(msg rpcMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] MCP -> %s\n", data)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err = c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// readLoop dispatches the server's messages until its stdout ends.
+// Responses go to the waiting call; requests from the server are answered
+// here, since ask offers it no capabilities beyond ping.
+func (c *mcpClient) readLoop(stdout io.Reader) {
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			c.handle(line)
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("the server exited")
+			}
+			c.err = err
+			close(c.done)
+			return
+		}
+	}
+}
+
+func (c *mcpClient) handle(line []byte) {
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] MCP <- %s\n", line)
+	}
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+	switch {
+	case msg.isResponse():
+		id, err := strconv.Atoi(string(msg.ID))
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		ch := c.pending[id]
+		c.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- msg:
+			default: // a duplicate response
+			}
+		}
+	case msg.isRequest():
+		reply := rpcMessage{JSONRPC: "2.0", ID: msg.ID}
+		if msg.Method == "ping" {
+			reply.Result = json.RawMessage("{}")
+		} else {
+			reply.Error = &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method}
+		}
+		c.send(reply)
+	}
+}
+
+// close stops the server.
+func (c *mcpClient) close() {
+	c.stdin.Close()
+	c.cancel()
+	c.cmd.Wait()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// mcpServeTools are the tools "ask mcp-serve" offers to other agents. They
+// use the configured provider and the same session history as the CLI.
+var mcpServeTools = []tool{
+	{
+		Name:        "ask",
+		Description: "Ask the configured model a question and store the answer as a new ask session. Returns the answer and the session ID.",
+		Parameters: json.RawMessage(`{"type": "object", "properties": {
+			"prompt": {"type": "string", "description": "The question or task"},
+			"files": {"type": "array", "items": {"type": "string"}, "description": "Files, directories or globs to attach as context"},
+			"model": {"type": "string", "description": "Model to use instead of the configured one"}
+		}, "required": ["prompt"]}`),
+		Run: serveAsk,
+	},
+	{
+		Name:        "refine_session",
+		Description: "Continue a stored ask session with a follow-up request, including any command output or context added since its answer. Returns the new answer and session ID.",
+		Parameters: json.RawMessage(`{"type": "object", "properties": {
+			"refinement": {"type": "string", "description": "The follow-up request"},
+			"session": {"type": "string", "description": "Session ID, unique ID prefix or \"last\" (the default)"},
+			"files": {"type": "array", "items": {"type": "string"}, "description": "Files, directories or globs to attach as context"},
+			"model": {"type": "string", "description": "Model to use instead of the configured one"}
+		}, "required": ["refinement"]}`),
+		Run: serveRefine,
+	},
+	{
+		Name:        "list_sessions",
+		Description: "List recent ask sessions with their ID, model, age and first prompt line, oldest first.",
+		Parameters: json.RawMessage(`{"type": "object", "properties": {
+			"limit": {"type": "integer", "description": "How many of the most recent sessions to list (default 20)"}
+		}}`),
+		Run: serveListSessions,
+	},
+	{
+		Name:        "extract_commands",
+		Description: "Extract the shell commands from an answer: the lines of its code blocks and lines starting with \"$ \". Returns a JSON array of strings.",
+		Parameters: json.RawMessage(`{"type": "object", "properties": {
+			"text": {"type": "string", "description": "The answer to extract commands from"},
+			"session": {"type": "string", "description": "Extract from this session's answer instead (ID, prefix or \"last\")"}
+		}}`),
+		Run: serveExtractCommands,
+	},
+}
+
+// defaultServeSessions is how many sessions list_sessions returns unless
+// asked for a different number.
+const defaultServeSessions = 20
+
+// handleMCPServe serves mcpServeTools over the Model Context Protocol on
+// stdin and stdout until stdin is closed.
+func handleMCPServe() {
+	out := &rpcWriter{w: os.Stdout}
+	// Stdout carries protocol messages only; anything ask would print for a
+	// person goes to stderr instead.
+	os.Stdout = os.Stderr
+	// Nobody is at a terminal to approve the model's tool calls.
+	toolPrompts = false
+	s := &mcpServe{out: out}
+	readRPCLines(os.Stdin, s.handle)
+	s.calls.wait()
+}
+
+// mcpServe is the server side of an MCP connection. Tool calls run in the
+// background so that they can be cancelled, but one at a time, since they
+// share ask's settings.
+type mcpServe struct {
+	out    *rpcWriter
+	calls  rpcCalls
+	callMu sync.Mutex
+}
+
+func (s *mcpServe) handle(line []byte) {
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] MCP <- %s\n", line)
+	}
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		s.out.reply(json.RawMessage("null"), nil, &rpcError{Code: rpcParseError, Message: err.Error()})
+		return
+	}
+	switch msg.Method {
+	case "initialize":
+		s.out.reply(msg.ID, map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "ask", "version": "1.0"},
+		}, nil)
+	case "ping":
+		s.out.reply(msg.ID, map[string]interface{}{}, nil)
+	case "tools/list":
+		var tools []map[string]interface{}
+		for _, t := range mcpServeTools {
+			tools = append(tools, map[string]interface{}{"name": t.Name, "description": t.Description, "inputSchema": t.Parameters})
+		}
+		s.out.reply(msg.ID, map[string]interface{}{"tools": tools}, nil)
+	case "tools/call":
+		if !msg.isRequest() {
+			return
+		}
+		ctx, done := s.calls.start(msg.ID)
+		go func() {
+			defer done()
+			s.call(ctx, msg)
+		}()
+	case "notifications/cancelled":
+		var params struct {
+			RequestID json.RawMessage `json:"requestId"`
+		}
+		if json.Unmarshal(msg.Params, &params) == nil {
+			s.calls.cancel(params.RequestID)
+		}
+	default:
+		// Other notifications, such as notifications/initialized, need
+		// nothing from ask.
+		if msg.isRequest() {
+			s.out.reply(msg.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method})
+		}
+	}
+}
+
+// call runs a tools/call request. Failures of the tool itself are results
+// flagged isError, so that the calling model sees them.
+func (s *mcpServe) call(ctx context.Context, msg rpcMessage) {
+	var params struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		s.out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()})
+		return
+	}
+	var t *tool
+	for i := range mcpServeTools {
+		if mcpServeTools[i].Name == params.Name {
+			t = &mcpServeTools[i]
+		}
+	}
+	if t == nil {
+		s.out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: "unknown tool: " + params.Name})
+		return
+	}
+	args := params.Arguments
+	if len(args) == 0 || string(args) == "null" {
+		args = json.RawMessage("{}")
+	}
+
+	s.callMu.Lock()
+	out, err := t.Run(ctx, args)
+	s.callMu.Unlock()
+	if ctx.Err() != nil {
+		// The client cancelled the request and expects no response.
+		return
+	}
+	if err != nil {
+		if out != "" {
+			out += "\n\n"
+		}
+		out += "Error: " + err.Error()
+	}
+	s.out.reply(msg.ID, map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": out}},
+		"isError": err != nil,
+	}, nil)
+}
+
+// serveArgs are the arguments of the served tools; each uses a subset.
+type serveArgs struct {
+	Prompt     string   `json:"prompt"`
+	Refinement string   `json:"refinement"`
+	Session    string   `json:"session"`
+	Files      []string `json:"files"`
+	Model      string   `json:"model"`
+	Text       string   `json:"text"`
+	Limit      int      `json:"limit"`
+}
+
+// useModel switches to the named model, if any, and returns a function that
+// switches back.
+func useModel(name string) func() {
+	previous := model
+	if name != "" {
+		model = name
+	}
+	return func() { model = previous }
+}
+
+func serveAsk(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args serveArgs
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(args.Prompt) == "" {
+		return "", errors.New("prompt is required")
+	}
+	entries, err := collectAttachments(args.Files)
+	if err != nil {
+		return "", err
+	}
+	defer useModel(args.Model)()
+	session, err := askNewSession(ctx, args.Prompt, "", entries, ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+	return servedAnswer(session)
+}
+
+func serveRefine(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args serveArgs
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(args.Refinement) == "" {
+		return "", errors.New("refinement is required")
+	}
+	if args.Session == "" {
+		args.Session = "last"
+	}
+	parent, err := resolveSession(args.Session)
+	if err != nil {
+		return "", err
+	}
+	extra, err := collectAttachments(args.Files)
+	if err != nil {
+		return "", err
+	}
+	defer useModel(args.Model)()
+	session, err := refineSession(ctx, parent, args.Refinement, extra, ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+	return servedAnswer(session)
+}
+
+// servedAnswer is what the ask and refine_session tools return: the answer
+// followed by the ID of the session it was stored in.
+func servedAnswer(s *Session) (string, error) {
+	out := fmt.Sprintf("%s\n\nSession: %s", s.Answer(), s.ID)
+	if s.Interrupted {
+		return out, errors.New("the answer was cut short")
+	}
+	return out, nil
+}
+
+func serveListSessions(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args serveArgs
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	if args.Limit <= 0 {
+		args.Limit = defaultServeSessions
+	}
+	sessions, err := listSessions()
+	if err != nil {
+		return "", err
+	}
+	if len(sessions) == 0 {
+		return "No sessions stored yet.", nil
+	}
+	if len(sessions) > args.Limit {
+		sessions = sessions[len(sessions)-args.Limit:]
+	}
+	var b strings.Builder
+	writeSessionTable(&b, sessions)
+	return b.String(), nil
+}
+
+func serveExtractCommands(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args serveArgs
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	text := args.Text
+	if text == "" {
+		if args.Session == "" {
+			args.Session = "last"
+		}
+		s, err := resolveSession(args.Session)
+		if err != nil {
+			return "", err
+		}
+		text = s.Answer()
+	}
+	commands := extractCommands(text)
+	if commands == nil {
+		commands = []string{}
+	}
+	data, err := json.Marshal(commands)
+	return string(data), err
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The tests start the test binary itself as a fake MCP server: run with
+// ASK_MCP_HELPER=1, TestMCPHelperServer serves on stdin and stdout.
+func fakeMCPServer() MCPServer {
+	return MCPServer{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=^TestMCPHelperServer$"},
+		Env:     map[string]string{"ASK_MCP_HELPER": "1"},
+	}
+}
+
+func TestMCPHelperServer(t *testing.T) {
+	if os.Getenv("ASK_MCP_HELPER") != "1" {
+		t.Skip("only runs as the fake MCP server")
+	}
+	serveFakeMCP()
+	os.Exit(0)
+}
+
+// serveFakeMCP speaks just enough MCP for the tests. It insists on the
+// handshake, lists its tools on two pages and offers:
+//
+//	echo       returns its arguments, a resource and an image
+//	fail       returns a result flagged isError
+//	slow       never answers, until cancelled
+//	cancelled  returns the IDs of the requests cancelled so far
+func serveFakeMCP() {
+	out := &rpcWriter{w: os.Stdout}
+	var mu sync.Mutex
+	initialized := false
+	var cancelled []string
+
+	pages := map[string]interface{}{
+		"": map[string]interface{}{
+			"tools": []map[string]interface{}{
+				{"name": "echo", "description": "Echo the arguments", "inputSchema": json.RawMessage(`{"type":"object","properties":{"text":{"type":"string"}}}`)},
+				{"name": "fail"},
+			},
+			"nextCursor": "page2",
+		},
+		"page2": map[string]interface{}{
+			"tools": []map[string]interface{}{{"name": "slow"}, {"name": "cancelled"}, {"name": "bad.name"}},
+		},
+	}
+
+	call := func(msg rpcMessage) {
+		var params struct {
+			Name      string                 `json:"name"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}
+		json.Unmarshal(msg.Params, &params)
+		text := func(s string) map[string]string { return map[string]string{"type": "text", "text": s} }
+		switch params.Name {
+		case "echo":
+			args, _ := json.Marshal(params.Arguments)
+			out.reply(msg.ID, map[string]interface{}{"content": []interface{}{
+				text(string(args)),
+				map[string]interface{}{"type": "resource", "resource": map[string]string{"uri": "file:///notes.txt", "text": "hello"}},
+				map[string]string{"type": "image", "data": "AAAA", "mimeType": "image/png"},
+			}}, nil)
+		case "fail":
+			out.reply(msg.ID, map[string]interface{}{"content": []interface{}{text("it broke")}, "isError": true}, nil)
+		case "slow":
+			// Cancelled requests get no response.
+		case "cancelled":
+			mu.Lock()
+			ids := strings.Join(cancelled, ",")
+			mu.Unlock()
+			out.reply(msg.ID, map[string]interface{}{"content": []interface{}{text(ids)}}, nil)
+		default:
+			out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: "unknown tool " + params.Name})
+		}
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var msg rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			continue
+		}
+		mu.Lock()
+		ready := initialized
+		mu.Unlock()
+		switch msg.Method {
+		case "initialize":
+			var params struct {
+				ProtocolVersion string `json:"protocolVersion"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			if params.ProtocolVersion != mcpProtocolVersion {
+				out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: "unsupported protocol version " + params.ProtocolVersion})
+				continue
+			}
+			out.reply(msg.ID, map[string]interface{}{
+				"protocolVersion": mcpProtocolVersion,
+				"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+				"serverInfo":      map[string]string{"name": "fake", "version": "1"},
+			}, nil)
+		case "notifications/initialized":
+			mu.Lock()
+			initialized = true
+			mu.Unlock()
+		case "notifications/cancelled":
+			var params struct {
+				RequestID json.RawMessage `json:"requestId"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			mu.Lock()
+			cancelled = append(cancelled, string(params.RequestID))
+			mu.Unlock()
+		case "tools/list", "tools/call":
+			if !ready {
+				out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidRequest, Message: "not initialized"})
+				continue
+			}
+			if msg.Method == "tools/call" {
+				go call(msg)
+				continue
+			}
+			var params struct {
+				Cursor string `json:"cursor"`
+			}
+			json.Unmarshal(msg.Params, &params)
+			out.reply(msg.ID, pages[params.Cursor], nil)
+		default:
+			if msg.isRequest() {
+				out.reply(msg.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method})
+			}
+		}
+	}
+}
+
+func startFakeMCPClient(t *testing.T) *mcpClient {
+	t.Helper()
+	client, err := newMCPClient(fakeMCPServer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.close)
+	return client
+}
+
+func TestMCPStartListsAllPages(t *testing.T) {
+	client := startFakeMCPClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	infos, err := client.start(ctx)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	if got, want := strings.Join(names, " "), "echo fail slow cancelled bad.name"; got != want {
+		t.Errorf("tools = %q, want %q", got, want)
+	}
+}
+
+func TestMCPServerToolNames(t *testing.T) {
+	tools, err := startMCPServer("my server", fakeMCPServer())
+	if err != nil {
+		t.Fatalf("startMCPServer: %v", err)
+	}
+	byName := map[string]tool{}
+	for _, tl := range tools {
+		byName[tl.Name] = tl
+		if tl.Policy != toolAsk {
+			t.Errorf("%s: policy %q, want %q", tl.Name, tl.Policy, toolAsk)
+		}
+	}
+	for _, name := range []string{"my_server__echo", "my_server__fail", "my_server__slow", "my_server__cancelled", "my_server__bad_name"} {
+		if _, ok := byName[name]; !ok {
+			t.Errorf("no tool named %s in %v", name, tools)
+		}
+	}
+	if got := string(byName["my_server__fail"].Parameters); !strings.Contains(got, `"object"`) {
+		t.Errorf("a tool without a schema got parameters %s, want an empty object schema", got)
+	}
+
+	out, err := byName["my_server__echo"].Run(context.Background(), json.RawMessage(`{"text":"hi"}`))
+	if err != nil {
+		t.Fatalf("echo: %v", err)
+	}
+	if want := "{\"text\":\"hi\"}\nfile:///notes.txt:\nhello\n[image content omitted]"; out != want {
+		t.Errorf("echo returned %q, want %q", out, want)
+	}
+}
+
+func TestMCPCallToolError(t *testing.T) {
+	client := startFakeMCPClient(t)
+	ctx := context.Background()
+	if _, err := client.start(ctx); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	out, err := client.callTool(ctx, "fail", json.RawMessage(`{}`))
+	if err == nil || out != "it broke" {
+		t.Errorf("fail returned %q, %v; want the text and an error", out, err)
+	}
+	if _, err := client.callTool(ctx, "missing", json.RawMessage(`{}`)); err == nil || !strings.Contains(err.Error(), "unknown tool") {
+		t.Errorf("calling an unknown tool returned %v, want the server's error", err)
+	}
+	if _, err := client.callTool(ctx, "echo", json.RawMessage(`"text"`)); err == nil {
+		t.Error("arguments that are not an object were accepted")
+	}
+}
+
+func TestMCPCallToolCancel(t *testing.T) {
+	client := startFakeMCPClient(t)
+	if _, err := client.start(context.Background()); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.callTool(ctx, "slow", json.RawMessage(`{}`))
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatal("a cancelled call succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled call did not return")
+	}
+
+	// The slow call was the fourth request, after initialize and the two
+	// tools/list pages.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		out, err := client.callTool(context.Background(), "cancelled", json.RawMessage(`{}`))
+		if err != nil {
+			t.Fatalf("cancelled: %v", err)
+		}
+		if out == "4" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the server saw cancellations of %q, want 4", out)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	featureSystemRole = "system"    // accepts a system message
+	featureStreaming  = "streaming" // supports streamed responses
+	featureTools      = "tools"     // supports tool/function calling
+)
+
+// ModelInfo describes a model's limits and capabilities. Entries in the
+// config's "models" section override the built-in ones field by field.
+type ModelInfo struct {
+	ContextWindow   int      `json:"context_window,omitempty"`
+	MaxOutputTokens int      `json:"max_output_tokens,omitempty"`
+	Tokenizer       string   `json:"tokenizer,omitempty"`
+	Features        []string `json:"features,omitempty"`
+}
+
+func (m ModelInfo) Supports(feature string) bool {
+	for _, f := range m.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	allFeatures      = []string{featureSystemRole, featureStreaming, featureTools}
+	chatFeatures     = []string{featureSystemRole, featureStreaming}
+	reasoningNoTools = []string{featureStreaming}
+)
+
+// builtinModels is keyed by model ID or ID prefix; the longest matching key
+// wins, so "gpt-4o-mini-2024-07-18" resolves to "gpt-4o-mini".
+var builtinModels = map[string]ModelInfo{
+	"gpt-3.5-turbo":      {ContextWindow: 16385, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-3.5-turbo-0613": {ContextWindow: 4096, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-3.5-turbo-16k":  {ContextWindow: 16385, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-4":              {ContextWindow: 8192, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-4-32k":          {ContextWindow: 32768, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-4-0125":         {ContextWindow: 128000, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-4-1106":         {ContextWindow: 128000, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-4-turbo":        {ContextWindow: 128000, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gpt-4o":             {ContextWindow: 128000, MaxOutputTokens: 16384, Tokenizer: tokenizerO200K, Features: allFeatures},
+	"gpt-4o-mini":        {ContextWindow: 128000, MaxOutputTokens: 16384, Tokenizer: tokenizerO200K, Features: allFeatures},
+	"chatgpt-4o":         {ContextWindow: 128000, MaxOutputTokens: 16384, Tokenizer: tokenizerO200K, Features: chatFeatures},
+	"gpt-4.1":            {ContextWindow: 1047576, MaxOutputTokens: 32768, Tokenizer: tokenizerO200K, Features: allFeatures},
+	"gpt-4.1-mini":       {ContextWindow: 1047576, MaxOutputTokens: 32768, Tokenizer: tokenizerO200K, Features: allFeatures},
+	"gpt-4.1-nano":       {ContextWindow: 1047576, MaxOutputTokens: 32768, Tokenizer: tokenizerO200K, Features: allFeatures},
+
+	"o1":         {ContextWindow: 200000, MaxOutputTokens: 100000, Tokenizer: tokenizerO200K, Features: []string{featureTools}},
+	"o1-mini":    {ContextWindow: 128000, MaxOutputTokens: 65536, Tokenizer: tokenizerO200K, Features: reasoningNoTools},
+	"o1-preview": {ContextWindow: 128000, MaxOutputTokens: 32768, Tokenizer: tokenizerO200K, Features: reasoningNoTools},
+	"o3":         {ContextWindow: 200000, MaxOutputTokens: 100000, Tokenizer: tokenizerO200K, Features: allFeatures},
+	"o3-mini":    {ContextWindow: 200000, MaxOutputTokens: 100000, Tokenizer: tokenizerO200K, Features: allFeatures},
+	"o4-mini":    {ContextWindow: 200000, MaxOutputTokens: 100000, Tokenizer: tokenizerO200K, Features: allFeatures},
+
+	"claude-3-haiku":    {ContextWindow: 200000, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"claude-3-opus":     {ContextWindow: 200000, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"claude-3-5-haiku":  {ContextWindow: 200000, MaxOutputTokens: 8192, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"claude-3-5-sonnet": {ContextWindow: 200000, MaxOutputTokens: 8192, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"claude-3-7-sonnet": {ContextWindow: 200000, MaxOutputTokens: 64000, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"claude-sonnet-4":   {ContextWindow: 200000, MaxOutputTokens: 64000, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"claude-opus-4":     {ContextWindow: 200000, MaxOutputTokens: 32000, Tokenizer: tokenizerCL100K, Features: allFeatures},
+
+	"llama3":            {ContextWindow: 8192, MaxOutputTokens: 2048, Tokenizer: tokenizerCL100K, Features: chatFeatures},
+	"llama3.1":          {ContextWindow: 131072, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"llama3.2":          {ContextWindow: 131072, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"llama3.3":          {ContextWindow: 131072, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"codellama":         {ContextWindow: 16384, MaxOutputTokens: 2048, Tokenizer: tokenizerCL100K, Features: chatFeatures},
+	"mistral":           {ContextWindow: 32768, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"qwen2.5":           {ContextWindow: 32768, MaxOutputTokens: 8192, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"qwen2.5-coder":     {ContextWindow: 32768, MaxOutputTokens: 8192, Tokenizer: tokenizerCL100K, Features: allFeatures},
+	"gemma2":            {ContextWindow: 8192, MaxOutputTokens: 2048, Tokenizer: tokenizerCL100K, Features: chatFeatures},
+	"phi3":              {ContextWindow: 4096, MaxOutputTokens: 2048, Tokenizer: tokenizerCL100K, Features: chatFeatures},
+	"deepseek-coder-v2": {ContextWindow: 131072, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: chatFeatures},
+	"deepseek-r1":       {ContextWindow: 131072, MaxOutputTokens: 8192, Tokenizer: tokenizerCL100K, Features: chatFeatures},
+}
+
+// defaultModelInfo is assumed for models the registry doesn't know.
+var defaultModelInfo = ModelInfo{ContextWindow: 8192, MaxOutputTokens: 4096, Tokenizer: tokenizerCL100K, Features: chatFeatures}
+
+// userModels holds overrides loaded from the config file, keyed by
+// lowercase model ID.
+var userModels map[string]ModelInfo
+
+// lowerModelKeys returns models keyed by lowercase ID, since model IDs are
+// matched case-insensitively.
+func lowerModelKeys(models map[string]ModelInfo) map[string]ModelInfo {
+	if models == nil {
+		return nil
+	}
+	lower := make(map[string]ModelInfo, len(models))
+	for id, info := range models {
+		lower[strings.ToLower(id)] = info
+	}
+	return lower
+}
+
+// lookupModel returns the capabilities of a model and whether it is known to
+// the registry. Unknown models get conservative defaults. A configured entry
+// applies unless a built-in one matches more closely, so that overriding
+// "gpt-4o" leaves "gpt-4o-mini" alone.
+func lookupModel(id string) (ModelInfo, bool) {
+	info := defaultModelInfo
+	builtin, known := matchModel(builtinModels, id)
+	if known {
+		info = builtinModels[builtin]
+	}
+	if key, ok := matchModel(userModels, id); ok && len(key) >= len(builtin) {
+		override := userModels[key]
+		known = true
+		if override.ContextWindow > 0 {
+			info.ContextWindow = override.ContextWindow
+		}
+		if override.MaxOutputTokens > 0 {
+			info.MaxOutputTokens = override.MaxOutputTokens
+		}
+		if override.Tokenizer != "" {
+			info.Tokenizer = override.Tokenizer
+		}
+		if override.Features != nil {
+			info.Features = override.Features
+		}
+	}
+	return info, known
+}
+
+// matchModel finds the longest key in models that is id or a prefix of it.
+// Ollama-style tags ("llama3:8b") match their base name.
+func matchModel(models map[string]ModelInfo, id string) (string, bool) {
+	id = strings.ToLower(id)
+	if _, ok := models[id]; ok {
+		return id, true
+	}
+	best := ""
+	for key := range models {
+		k := strings.ToLower(key)
+		if len(k) > len(best) && strings.HasPrefix(id, k) && (len(id) == len(k) || isModelSeparator(id[len(k)])) {
+			best = key
+		}
+	}
+	return best, best != ""
+}
+
+// isModelSeparator reports whether c can follow a model family name in a
+// longer ID, so that "o1" matches "o1-2024-12-17" but not "o10".
+func isModelSeparator(c byte) bool {
+	return c == '-' || c == ':' || c == '@' || c == '/'
+}
+
+// promptBudget returns how many tokens the prompt may use: the model's
+// context window minus room for the reply, capped by the user's max_tokens.
+func promptBudget() int {
+	info, _ := lookupModel(model)
+	budget := info.ContextWindow - info.MaxOutputTokens
+	if budget <= 0 {
+		budget = info.ContextWindow
+	}
+	if maxTokens > 0 && maxTokens < budget {
+		budget = maxTokens
+	}
+	return budget
+}
+
+// registeredModelIDs lists the built-in and configured registry keys.
+func registeredModelIDs() []string {
+	seen := map[string]bool{}
+	var ids []string
+	for id := range builtinModels {
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for id := range userModels {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
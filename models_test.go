@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+func TestLookupModel(t *testing.T) {
+	saved := userModels
+	t.Cleanup(func() { userModels = saved })
+	userModels = nil
+
+	tests := []struct {
+		id      string
+		window  int
+		output  int
+		known   bool
+		matched string // the registry key expected to match, for the message
+	}{
+		{"gpt-4o", 128000, 16384, true, "gpt-4o"},
+		{"gpt-4o-mini", 128000, 16384, true, "gpt-4o-mini"},
+		{"gpt-4o-mini-2024-07-18", 128000, 16384, true, "gpt-4o-mini"},
+		{"gpt-4o-2024-08-06", 128000, 16384, true, "gpt-4o"},
+		{"GPT-4O", 128000, 16384, true, "gpt-4o"},
+		{"gpt-4", 8192, 4096, true, "gpt-4"},
+		{"gpt-4-0613", 8192, 4096, true, "gpt-4"},
+		{"gpt-4-32k-0613", 32768, 4096, true, "gpt-4-32k"},
+		{"gpt-4-turbo-2024-04-09", 128000, 4096, true, "gpt-4-turbo"},
+		{"gpt-4.1-mini-2025-04-14", 1047576, 32768, true, "gpt-4.1-mini"},
+		{"claude-3-5-sonnet@20240620", 200000, 8192, true, "claude-3-5-sonnet"},
+		{"claude-3-5-sonnet-20241022", 200000, 8192, true, "claude-3-5-sonnet"},
+		{"claude-3-7-sonnet-latest", 200000, 64000, true, "claude-3-7-sonnet"},
+		{"llama3:8b", 8192, 2048, true, "llama3"},
+		{"llama3.1:70b", 131072, 4096, true, "llama3.1"},
+		{"qwen2.5-coder:7b", 32768, 8192, true, "qwen2.5-coder"},
+		{"o1", 200000, 100000, true, "o1"},
+		{"o1-2024-12-17", 200000, 100000, true, "o1"},
+		{"o1-mini-2024-09-12", 128000, 65536, true, "o1-mini"},
+		{"deepseek-r1/distill", 131072, 8192, true, "deepseek-r1"},
+
+		// A prefix only counts when a separator follows it.
+		{"o10", defaultModelInfo.ContextWindow, defaultModelInfo.MaxOutputTokens, false, ""},
+		{"gpt-4oo", defaultModelInfo.ContextWindow, defaultModelInfo.MaxOutputTokens, false, ""},
+		{"llama30", defaultModelInfo.ContextWindow, defaultModelInfo.MaxOutputTokens, false, ""},
+		{"gpt-4.5-preview", defaultModelInfo.ContextWindow, defaultModelInfo.MaxOutputTokens, false, ""},
+		{"my-finetune", defaultModelInfo.ContextWindow, defaultModelInfo.MaxOutputTokens, false, ""},
+		{"", defaultModelInfo.ContextWindow, defaultModelInfo.MaxOutputTokens, false, ""},
+	}
+	for _, tt := range tests {
+		info, known := lookupModel(tt.id)
+		if known != tt.known || info.ContextWindow != tt.window || info.MaxOutputTokens != tt.output {
+			t.Errorf("lookupModel(%q) = %d/%d known %v, want %d/%d known %v (%s)",
+				tt.id, info.ContextWindow, info.MaxOutputTokens, known, tt.window, tt.output, tt.known, tt.matched)
+		}
+	}
+
+	if info, _ := lookupModel("o1"); info.Supports(featureSystemRole) || !info.Supports(featureTools) {
+		t.Errorf("o1 features = %v", info.Features)
+	}
+	if got := tokenizerForModel("gpt-4o-mini"); got != tokenizerO200K {
+		t.Errorf("gpt-4o-mini tokenizer = %s", got)
+	}
+	if got := tokenizerForModel("unknown-model"); got != tokenizerCL100K {
+		t.Errorf("unknown model tokenizer = %s", got)
+	}
+}
+
+func TestLookupModelUserOverrides(t *testing.T) {
+	saved := userModels
+	t.Cleanup(func() { userModels = saved })
+	userModels = lowerModelKeys(map[string]ModelInfo{
+		"GPT-4o":      {MaxOutputTokens: 1000},
+		"my-finetune": {ContextWindow: 4000, Features: []string{featureStreaming}},
+		"llama3:70b":  {ContextWindow: 65536},
+	})
+
+	info, known := lookupModel("gpt-4o-2024-08-06")
+	if !known || info.ContextWindow != 128000 || info.MaxOutputTokens != 1000 || info.Tokenizer != tokenizerO200K {
+		t.Errorf("override of gpt-4o = %+v known %v; want only max output changed", info, known)
+	}
+	info, _ = lookupModel("gpt-4o-mini")
+	if info.MaxOutputTokens != 16384 {
+		t.Errorf("the gpt-4o override applied to gpt-4o-mini: %+v", info)
+	}
+	info, known = lookupModel("My-Finetune:latest")
+	if !known || info.ContextWindow != 4000 || info.MaxOutputTokens != defaultModelInfo.MaxOutputTokens || info.Supports(featureSystemRole) {
+		t.Errorf("user model = %+v known %v", info, known)
+	}
+	if info, _ := lookupModel("llama3:70b"); info.ContextWindow != 65536 {
+		t.Errorf("llama3:70b = %+v, want the more specific user entry", info)
+	}
+	if info, _ := lookupModel("llama3:8b"); info.ContextWindow != 8192 {
+		t.Errorf("llama3:8b = %+v, want the built-in entry", info)
+	}
+}
+
+func TestPromptBudget(t *testing.T) {
+	savedModel, savedMax, savedUser := model, maxTokens, userModels
+	t.Cleanup(func() { model, maxTokens, userModels = savedModel, savedMax, savedUser })
+	userModels = lowerModelKeys(map[string]ModelInfo{"tiny": {ContextWindow: 2048, MaxOutputTokens: 4096}})
+
+	tests := []struct {
+		model     string
+		maxTokens int
+		want      int
+	}{
+		{"gpt-4", 0, 8192 - 4096},
+		{"gpt-4o-mini", 0, 128000 - 16384},
+		{"gpt-4o-mini", 1000, 1000},
+		{"gpt-4", 100000, 8192 - 4096},
+		{"unknown-model", 0, defaultModelInfo.ContextWindow - defaultModelInfo.MaxOutputTokens},
+		// A reply limit as large as the window leaves the whole window.
+		{"tiny", 0, 2048},
+		{"tiny", 500, 500},
+	}
+	for _, tt := range tests {
+		model, maxTokens = tt.model, tt.maxTokens
+		if got := promptBudget(); got != tt.want {
+			t.Errorf("promptBudget() for %s with max_tokens %d = %d, want %d", tt.model, tt.maxTokens, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Output formats selected with -o. Text is for people; json prints one
+// object (or array) when done, and jsonl prints one object per line as
+// things happen, streaming the answer as it arrives.
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputJSONL = "jsonl"
+)
+
+var outputFormats = []string{outputText, outputJSON, outputJSONL}
+
+// outputFormat is the format of what ask prints to stdout. In the machine
+// formats, stdout carries JSON only; messages for people go to stderr.
+var outputFormat = outputText
+
+const outputUsage = "Output format: text, json (one object when done) or jsonl (one event per line, streaming the answer)"
+
+func setOutputFormat(f string) {
+	if f == "" {
+		return
+	}
+	for _, known := range outputFormats {
+		if f == known {
+			outputFormat = f
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Unknown output format %q (available: %s)\n", f, strings.Join(outputFormats, ", "))
+	os.Exit(1)
+}
+
+// answerResult describes an answer for programs: the session it is stored
+// in, the answer and the commands found in it. Truncated is set when the
+// answer is incomplete, because it reached the output token limit or was
+// cut short; Interrupted tells the latter apart. ContextTrimmed is set when
+// the prompt was cut to fit the budget, so the model saw less than was sent.
+type answerResult struct {
+	SessionID      string       `json:"session_id"`
+	ParentID       string       `json:"parent_id,omitempty"`
+	Model          string       `json:"model"`
+	Answer         string       `json:"answer"`
+	Commands       []string     `json:"commands"`
+	Usage          SessionUsage `json:"usage"`
+	Truncated      bool         `json:"truncated"`
+	ContextTrimmed bool         `json:"context_trimmed"`
+	Interrupted    bool         `json:"interrupted,omitempty"`
+}
+
+func newAnswerResult(s *Session) answerResult {
+	commands := extractCommands(s.Answer())
+	if commands == nil {
+		commands = []string{}
+	}
+	return answerResult{
+		SessionID:      s.ID,
+		ParentID:       s.ParentID,
+		Model:          s.Model,
+		Answer:         s.Answer(),
+		Commands:       commands,
+		Usage:          s.Usage,
+		Truncated:      s.Truncated || s.Interrupted,
+		ContextTrimmed: s.ContextTrimmed,
+		Interrupted:    s.Interrupted,
+	}
+}
+
+// sessionSummary is one entry of a session listing.
+type sessionSummary struct {
+	ID          string    `json:"id"`
+	ParentID    string    `json:"parent_id,omitempty"`
+	Model       string    `json:"model"`
+	Created     time.Time `json:"created"`
+	Title       string    `json:"title"`
+	Interrupted bool      `json:"interrupted,omitempty"`
+}
+
+func newSessionSummary(s *Session) sessionSummary {
+	return sessionSummary{ID: s.ID, ParentID: s.ParentID, Model: s.Model, Created: s.Created, Title: firstLine(s.FirstPrompt(), 80), Interrupted: s.Interrupted}
+}
+
+// modelSummary is one entry of a model listing. Models the registry doesn't
+// know are listed with the defaults ask assumes for them.
+type modelSummary struct {
+	ID      string `json:"id"`
+	Current bool   `json:"current,omitempty"`
+	Known   bool   `json:"known"`
+	ModelInfo
+}
+
+// grepMatch is a line of a stored session that matched "ask sessions grep".
+type grepMatch struct {
+	SessionID string `json:"session_id"`
+	Where     string `json:"where"`
+	Line      string `json:"line"`
+}
+
+// outputEvent is a line of -o jsonl output while answering: "delta" events
+// carry the text as it arrives and the final "answer" event the result.
+type outputEvent struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	*answerResult
+}
+
+// printJSON prints v to stdout as one line of JSON.
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// printRecords prints a listing as one JSON array with -o json, or as one
+// record per line with -o jsonl.
+func printRecords(records []interface{}) {
+	if outputFormat == outputJSONL {
+		for _, r := range records {
+			printJSON(r)
+		}
+		return
+	}
+	if records == nil {
+		records = []interface{}{}
+	}
+	printJSON(records)
+}
+
+// answerOutput is where the answer is streamed to while it arrives.
+func answerOutput() io.Writer {
+	switch outputFormat {
+	case outputJSON:
+		return ioutil.Discard
+	case outputJSONL:
+		return deltaWriter{}
+	}
+	return os.Stdout
+}
+
+// deltaWriter prints what is written to it as jsonl "delta" events.
+type deltaWriter struct{}
+
+func (deltaWriter) Write(p []byte) (int, error) {
+	printJSON(outputEvent{Type: "delta", Text: string(p)})
+	return len(p), nil
+}
+
+// printAnswerResult prints the result of answering in the machine formats.
+func printAnswerResult(s *Session) {
+	result := newAnswerResult(s)
+	if outputFormat == outputJSONL {
+		printJSON(outputEvent{Type: "answer", answerResult: &result})
+		return
+	}
+	printJSON(result)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// setProcessGroup is a no-op where process groups aren't available;
+// cancelling cmd kills only the shell.
+func setProcessGroup(cmd *exec.Cmd) {}
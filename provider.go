@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	providerOpenAI    = "openai"
+	providerLocal     = "local"
+	providerAnthropic = "anthropic"
+
+	defaultLocalBaseURL     = "http://localhost:11434/v1" // Ollama's OpenAI-compatible endpoint
+	defaultAnthropicBaseURL = "https://api.anthropic.com"
+	anthropicAPIVersion     = "2023-06-01"
+)
+
+// defaultModels is used when neither the config nor -model picked a model.
+var defaultModels = map[string]string{
+	providerOpenAI:    "gpt-4",
+	providerLocal:     "llama3",
+	providerAnthropic: "claude-3-5-sonnet-latest",
+}
+
+// Provider is a chat backend. Requests and responses use the OpenAI types as
+// the common format; other backends translate to and from them.
+type Provider interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	// CreateChatCompletionStream calls onDelta with each piece of text as it
+	// arrives and returns the assembled response once the stream ends.
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionResponse, error)
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+func newProvider() (Provider, error) {
+	switch providerName {
+	case providerOpenAI, "":
+		if apiKey == "" {
+			return nil, errors.New("no API key found. Set OPENAI_API_KEY or run `ask config set-key <YOUR_API_KEY>`")
+		}
+		cfg := openai.DefaultConfig(apiKey)
+		if baseURL != "" {
+			cfg.BaseURL = baseURL
+		}
+		return &openaiProvider{client: openai.NewClientWithConfig(cfg), includeUsage: true}, nil
+	case providerLocal:
+		// Local servers (Ollama, llama.cpp) usually ignore the key, but pass it
+		// along in case the endpoint sits behind an authenticating proxy.
+		cfg := openai.DefaultConfig(apiKey)
+		cfg.BaseURL = defaultLocalBaseURL
+		if baseURL != "" {
+			cfg.BaseURL = baseURL
+		}
+		return &openaiProvider{client: openai.NewClientWithConfig(cfg)}, nil
+	case providerAnthropic:
+		if anthropicAPIKey == "" {
+			return nil, errors.New("no Anthropic API key found. Set ANTHROPIC_API_KEY or run `ask config set-anthropic-key <YOUR_API_KEY>`")
+		}
+		url := defaultAnthropicBaseURL
+		if baseURL != "" {
+			url = baseURL
+		}
+		return &anthropicProvider{apiKey: anthropicAPIKey, baseURL: strings.TrimRight(url, "/"), client: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q (available: %s, %s, %s)", providerName, providerOpenAI, providerLocal, providerAnthropic)
+	}
+}
+
+var (
+	providerMu       sync.Mutex
+	providerCache    Provider
+	providerCacheKey string
+)
+
+// cachedProvider returns the provider made last time if the settings it was
+// made from haven't changed, so that a long-running ask ("ask serve") keeps
+// its client and connections warm between requests.
+func cachedProvider() (Provider, error) {
+	key := strings.Join([]string{providerName, baseURL, apiKey, anthropicAPIKey}, "\x00")
+	providerMu.Lock()
+	defer providerMu.Unlock()
+	if providerCache != nil && providerCacheKey == key {
+		return providerCache, nil
+	}
+	p, err := newProvider()
+	if err != nil {
+		return nil, err
+	}
+	providerCache, providerCacheKey = p, key
+	return p, nil
+}
+
+// openaiProvider talks to the OpenAI API or any server implementing the same
+// chat completions protocol.
+type openaiProvider struct {
+	client *openai.Client
+	// includeUsage requests a usage chunk at the end of streams. Not every
+	// OpenAI-compatible server accepts stream_options, so it is opt-in.
+	includeUsage bool
+}
+
+func (p *openaiProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	return p.client.CreateChatCompletion(ctx, req)
+}
+
+func (p *openaiProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionResponse, error) {
+	if p.includeUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+	stream, err := p.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer stream.Close()
+
+	resp := openai.ChatCompletionResponse{Model: req.Model}
+	var content strings.Builder
+	var toolCalls []openai.ToolCall
+	var finishReason openai.FinishReason
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return openai.ChatCompletionResponse{}, err
+		}
+		resp.ID = chunk.ID
+		if chunk.Model != "" {
+			resp.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			resp.Usage = *chunk.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		choice := chunk.Choices[0]
+		if choice.Delta.Content != "" {
+			content.WriteString(choice.Delta.Content)
+			onDelta(choice.Delta.Content)
+		}
+		toolCalls = accumulateToolCalls(toolCalls, choice.Delta.ToolCalls)
+		if choice.FinishReason != "" {
+			finishReason = choice.FinishReason
+		}
+	}
+
+	resp.Choices = []openai.ChatCompletionChoice{{
+		Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content.String(), ToolCalls: toolCalls},
+		FinishReason: finishReason,
+	}}
+	return resp, nil
+}
+
+// accumulateToolCalls merges the tool call fragments of one stream chunk
+// into calls. The first fragment of a call carries its ID and name; the
+// arguments arrive in pieces, addressed by index.
+func accumulateToolCalls(calls []openai.ToolCall, deltas []openai.ToolCall) []openai.ToolCall {
+	for _, d := range deltas {
+		i := len(calls) - 1
+		if d.Index != nil {
+			i = *d.Index
+		} else if d.ID != "" || i < 0 {
+			i = len(calls)
+		}
+		for len(calls) <= i {
+			calls = append(calls, openai.ToolCall{Type: openai.ToolTypeFunction})
+		}
+		if d.ID != "" {
+			calls[i].ID = d.ID
+		}
+		if d.Function.Name != "" {
+			calls[i].Function.Name = d.Function.Name
+		}
+		calls[i].Function.Arguments += d.Function.Arguments
+	}
+	return calls
+}
+
+func (p *openaiProvider) ListModels(ctx context.Context) ([]string, error) {
+	resp, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range resp.Models {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+// anthropicProvider implements the Anthropic Messages API.
+type anthropicProvider struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+}
+
+// anthropicMessage holds either plain text or, for turns with tool calls
+// and results, a list of content blocks.
+type anthropicMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+// anthropicBlock is a content block: text, a tool_use the model asked for,
+// or the tool_result answering it.
+type anthropicBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	InputSchema interface{} `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	MaxTokens int                `json:"max_tokens"`
+	Tools     []anthropicTool    `json:"tools,omitempty"`
+	Stream    bool               `json:"stream,omitempty"`
+}
+
+type anthropicResponse struct {
+	ID         string           `json:"id"`
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// anthropicStreamEvent covers the fields ask uses from the Messages API
+// server-sent events.
+type anthropicStreamEvent struct {
+	Type         string            `json:"type"`
+	Message      anthropicResponse `json:"message"`
+	Index        int               `json:"index"`
+	ContentBlock anthropicBlock    `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Usage struct {
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func newAnthropicRequest(req openai.ChatCompletionRequest) anthropicRequest {
+	areq := anthropicRequest{Model: req.Model, MaxTokens: req.MaxTokens}
+	if areq.MaxTokens == 0 {
+		// The Messages API requires an explicit output limit.
+		info, _ := lookupModel(req.Model)
+		areq.MaxTokens = info.MaxOutputTokens
+	}
+	for _, t := range req.Tools {
+		if t.Function != nil {
+			areq.Tools = append(areq.Tools, anthropicTool{Name: t.Function.Name, Description: t.Function.Description, InputSchema: t.Function.Parameters})
+		}
+	}
+	for _, m := range req.Messages {
+		switch {
+		case m.Role == openai.ChatMessageRoleSystem:
+			// Anthropic takes the system prompt as a top-level field.
+			if areq.System != "" {
+				areq.System += "\n\n"
+			}
+			areq.System += m.Content
+		case m.Role == openai.ChatMessageRoleTool:
+			// Tool results are blocks of a user turn; results of calls made
+			// in the same turn share one.
+			block := anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content}
+			if n := len(areq.Messages); n > 0 && areq.Messages[n-1].Role == openai.ChatMessageRoleUser {
+				if blocks, ok := areq.Messages[n-1].Content.([]anthropicBlock); ok {
+					areq.Messages[n-1].Content = append(blocks, block)
+					continue
+				}
+			}
+			areq.Messages = append(areq.Messages, anthropicMessage{Role: openai.ChatMessageRoleUser, Content: []anthropicBlock{block}})
+		case len(m.ToolCalls) > 0:
+			var blocks []anthropicBlock
+			if m.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+			areq.Messages = append(areq.Messages, anthropicMessage{Role: m.Role, Content: blocks})
+		default:
+			areq.Messages = append(areq.Messages, anthropicMessage{Role: m.Role, Content: m.Content})
+		}
+	}
+	return areq
+}
+
+// chatCompletionResponse converts a Messages API response, turning
+// tool_use blocks into tool calls.
+func (r anthropicResponse) chatCompletionResponse() openai.ChatCompletionResponse {
+	msg := openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant}
+	var text strings.Builder
+	for _, c := range r.Content {
+		switch c.Type {
+		case "text":
+			text.WriteString(c.Text)
+		case "tool_use":
+			args := string(c.Input)
+			if args == "" {
+				args = "{}"
+			}
+			msg.ToolCalls = append(msg.ToolCalls, openai.ToolCall{ID: c.ID, Type: openai.ToolTypeFunction, Function: openai.FunctionCall{Name: c.Name, Arguments: args}})
+		}
+	}
+	msg.Content = text.String()
+	return openai.ChatCompletionResponse{
+		ID:    r.ID,
+		Model: r.Model,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      msg,
+			FinishReason: anthropicFinishReason(r.StopReason),
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     r.Usage.InputTokens,
+			CompletionTokens: r.Usage.OutputTokens,
+			TotalTokens:      r.Usage.InputTokens + r.Usage.OutputTokens,
+		},
+	}
+}
+
+func (p *anthropicProvider) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	areq := newAnthropicRequest(req)
+
+	var aresp anthropicResponse
+	if err := p.do(ctx, http.MethodPost, "/v1/messages", areq, &aresp); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	return aresp.chatCompletionResponse(), nil
+}
+
+func (p *anthropicProvider) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest, onDelta func(string)) (openai.ChatCompletionResponse, error) {
+	areq := newAnthropicRequest(req)
+	areq.Stream = true
+
+	body, err := p.send(ctx, http.MethodPost, "/v1/messages", areq)
+	if err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	defer body.Close()
+
+	// Blocks are filled in by index; tool inputs arrive as JSON fragments.
+	var aresp anthropicResponse
+	var inputs []string
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var ev anthropicStreamEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &ev); err != nil {
+			return openai.ChatCompletionResponse{}, fmt.Errorf("anthropic: decoding stream event: %w", err)
+		}
+		switch ev.Type {
+		case "message_start":
+			aresp.ID = ev.Message.ID
+			aresp.Model = ev.Message.Model
+			aresp.Usage.InputTokens = ev.Message.Usage.InputTokens
+		case "content_block_start":
+			for len(aresp.Content) <= ev.Index {
+				aresp.Content = append(aresp.Content, anthropicBlock{})
+				inputs = append(inputs, "")
+			}
+			aresp.Content[ev.Index] = ev.ContentBlock
+		case "content_block_delta":
+			if ev.Index >= len(aresp.Content) {
+				continue
+			}
+			switch ev.Delta.Type {
+			case "text_delta":
+				aresp.Content[ev.Index].Text += ev.Delta.Text
+				onDelta(ev.Delta.Text)
+			case "input_json_delta":
+				inputs[ev.Index] += ev.Delta.PartialJSON
+			}
+		case "message_delta":
+			aresp.StopReason = ev.Delta.StopReason
+			aresp.Usage.OutputTokens = ev.Usage.OutputTokens
+		case "error":
+			return openai.ChatCompletionResponse{}, fmt.Errorf("anthropic: %s: %s", ev.Error.Type, ev.Error.Message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	for i := range aresp.Content {
+		if aresp.Content[i].Type == "tool_use" && inputs[i] != "" {
+			aresp.Content[i].Input = json.RawMessage(inputs[i])
+		}
+	}
+	return aresp.chatCompletionResponse(), nil
+}
+
+func (p *anthropicProvider) ListModels(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := p.do(ctx, http.MethodGet, "/v1/models", nil, &resp); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, m := range resp.Data {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+func (p *anthropicProvider) do(ctx context.Context, method, path string, body, out interface{}) error {
+	respBody, err := p.send(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer respBody.Close()
+
+	data, err := ioutil.ReadAll(respBody)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// send performs a request and returns the body of a successful response.
+// Error responses are decoded into an error.
+func (p *anthropicProvider) send(ctx context.Context, method, path string, body interface{}) (io.ReadCloser, error) {
+	var reqBody *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	} else {
+		reqBody = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", p.apiKey)
+	req.Header.Set("anthropic-version", anthropicAPIVersion)
+	req.Header.Set("content-type", "application/json")
+
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Anthropic request: %s %s\n", method, p.baseURL+path)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		var aerr anthropicError
+		if json.Unmarshal(data, &aerr) == nil && aerr.Error.Message != "" {
+			return nil, fmt.Errorf("anthropic: %s: %s (status %d)", aerr.Error.Type, aerr.Error.Message, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("anthropic: unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp.Body, nil
+}
+
+func anthropicFinishReason(stopReason string) openai.FinishReason {
+	switch stopReason {
+	case "max_tokens":
+		return openai.FinishReasonLength
+	case "tool_use":
+		return openai.FinishReasonToolCalls
+	default:
+		return openai.FinishReasonStop
+	}
+}
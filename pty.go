@@ -0,0 +1,73 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ptyMode runs commands extracted from answers on a pseudo-terminal (see
+// pty_unix.go), so interactive programs get the real terminal.
+var ptyMode bool
+
+// maxTranscriptBytes caps how much of a PTY run's output is kept for the
+// session; the end is kept, since that is where errors usually are.
+const maxTranscriptBytes = 1 << 20
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max     int
+	buf     []byte
+	dropped bool
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = append(t.buf[:0], t.buf[over:]...)
+		t.dropped = true
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	if t.dropped {
+		return "[earlier output omitted]\n" + string(t.buf)
+	}
+	return string(t.buf)
+}
+
+// terminalEscape matches the escape sequences programs send to a terminal:
+// CSI sequences (colors, cursor movement), OSC sequences (window titles,
+// hyperlinks) and the remaining two-byte escapes.
+var terminalEscape = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[ -/]*[0-~]`)
+
+// cleanTranscript turns what a program wrote to a terminal into plain text
+// for the session: escape sequences are removed, and carriage returns and
+// backspaces are applied the way the terminal would, so progress bars and
+// prompts the user typed over leave only their final state.
+func cleanTranscript(s string) string {
+	s = terminalEscape.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		if j := strings.LastIndexByte(strings.TrimRight(line, "\r"), '\r'); j >= 0 {
+			line = line[j+1:]
+		}
+		line = strings.TrimRight(line, "\r")
+		if strings.IndexByte(line, '\b') >= 0 {
+			var b []rune
+			for _, r := range line {
+				if r == '\b' {
+					if len(b) > 0 {
+						b = b[:len(b)-1]
+					}
+					continue
+				}
+				b = append(b, r)
+			}
+			line = string(b)
+		}
+		lines[i] = line
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// runCommandPTY falls back to runCommand where pseudo-terminals aren't
+// available.
+func runCommandPTY(cmd *exec.Cmd) (commandResult, error) {
+	fmt.Fprintln(os.Stderr, "PTY mode is not supported on this platform; running the command without a PTY.")
+	return runCommand(cmd)
+}
@@ -0,0 +1,144 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+)
+
+// runCommandPTY runs cmd on a new pseudo-terminal wired to ask's terminal,
+// so that interactive programs ("git rebase -i", top, psql) can read keys
+// and draw the screen. Everything shown is also kept as a transcript,
+// returned as Stdout; on a terminal stdout and stderr can't be told apart.
+// Without a terminal, cmd is run with runCommand instead.
+func runCommandPTY(cmd *exec.Cmd) (commandResult, error) {
+	// Opened rather than taken from os.Stdin so that it is pollable and
+	// reading from it can be stopped once cmd exits.
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "No terminal available; running the command without a PTY.")
+		return runCommand(cmd)
+	}
+	defer tty.Close()
+
+	// cmd leads a new session with the PTY as its controlling terminal.
+	// Its process group is that of the session, so cancelling cmd still
+	// kills everything it started.
+	attrs := &syscall.SysProcAttr{}
+	if cmd.SysProcAttr != nil {
+		*attrs = *cmd.SysProcAttr
+	}
+	attrs.Setpgid = false
+	attrs.Setsid = true
+	attrs.Setctty = true
+
+	start := time.Now()
+	ptmx, err := pty.StartWithAttrs(cmd, terminalSize(tty), attrs)
+	if err != nil {
+		return commandResult{ExitCode: -1}, err
+	}
+	defer ptmx.Close()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer func() {
+		signal.Stop(winch)
+		close(winch)
+	}()
+	go func() {
+		for range winch {
+			if size := terminalSize(tty); size != nil {
+				pty.Setsize(ptmx, size)
+			}
+		}
+	}()
+
+	// Keys go to the program as typed, including Ctrl+C.
+	restore, err := makeRaw(tty)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot put the terminal in raw mode: %v\n", err)
+		restore = func() {}
+	}
+
+	transcript := &tailBuffer{max: maxTranscriptBytes}
+	outputDone := make(chan struct{})
+	go func() {
+		io.Copy(io.MultiWriter(os.Stdout, transcript), ptmx)
+		close(outputDone)
+	}()
+	inputDone := make(chan struct{})
+	go func() {
+		io.Copy(ptmx, tty)
+		close(inputDone)
+	}()
+
+	err = cmd.Wait()
+	duration := time.Since(start)
+	// Give the output left in the PTY time to drain; a background process
+	// still holding the terminal doesn't keep ask waiting.
+	select {
+	case <-outputDone:
+	case <-time.After(commandWaitDelay):
+		ptmx.Close()
+		<-outputDone
+	}
+	// Stop reading keys before handing the terminal back, so that nothing
+	// typed after the command exited is lost.
+	if tty.SetReadDeadline(time.Now()) == nil {
+		<-inputDone
+	}
+	restore()
+
+	res := commandResult{Stdout: cleanTranscript(transcript.String()), ExitCode: -1, Duration: duration, PTY: true}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return res, err
+}
+
+// terminalSize returns the size of tty, or nil if it can't be read. The
+// descriptor is used through SyscallConn, since Fd would make tty blocking.
+func terminalSize(tty *os.File) *pty.Winsize {
+	conn, err := tty.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ws *unix.Winsize
+	conn.Control(func(fd uintptr) {
+		ws, _ = unix.IoctlGetWinsize(int(fd), unix.TIOCGWINSZ)
+	})
+	if ws == nil {
+		return nil
+	}
+	return &pty.Winsize{Rows: ws.Row, Cols: ws.Col, X: ws.Xpixel, Y: ws.Ypixel}
+}
+
+// makeRaw puts tty in raw mode and returns a function that restores it.
+func makeRaw(tty *os.File) (func(), error) {
+	conn, err := tty.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var state *readline.State
+	conn.Control(func(fd uintptr) {
+		state, err = readline.MakeRaw(int(fd))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		conn.Control(func(fd uintptr) {
+			readline.Restore(int(fd), state)
+		})
+	}, nil
+}
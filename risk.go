@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+type riskLevel int
+
+const (
+	riskNone riskLevel = iota
+	riskMedium
+	riskHigh
+)
+
+func (l riskLevel) String() string {
+	switch l {
+	case riskHigh:
+		return "high"
+	case riskMedium:
+		return "medium"
+	}
+	return "none"
+}
+
+func parseRiskLevel(s string) (riskLevel, bool) {
+	switch strings.ToLower(s) {
+	case "high":
+		return riskHigh, true
+	case "medium":
+		return riskMedium, true
+	case "none", "off":
+		return riskNone, true
+	}
+	return riskNone, false
+}
+
+// Risk categories.
+const (
+	riskDestructive = "destructive"
+	riskPrivilege   = "privilege"
+	riskPipeToShell = "pipe-to-shell"
+	riskOutsideCwd  = "outside-cwd"
+	riskNetwork     = "network"
+)
+
+// RiskRule flags commands by program name and arguments. Rules from the
+// config are added to the built-in ones; a rule with the name of a built-in
+// rule replaces it.
+type RiskRule struct {
+	Name     string   `json:"name"`
+	Category string   `json:"category"`
+	Level    string   `json:"level"`              // "medium" or "high"
+	Commands []string `json:"commands"`           // program names; globs like "mkfs*" are allowed
+	Args     string   `json:"args,omitempty"`     // regexp matched against the space-joined arguments
+	Message  string   `json:"message,omitempty"`  // shown in the risk banner
+	Disabled bool     `json:"disabled,omitempty"` // turns a built-in rule off
+}
+
+// RiskConfig configures dangerous-command detection.
+type RiskConfig struct {
+	Rules []RiskRule `json:"rules,omitempty"`
+	// Disable lists rule names to turn off, including the structural checks
+	// (pipe-to-shell, exec-generated-code, write-outside-cwd,
+	// write-system-path, unparsable).
+	Disable []string `json:"disable,omitempty"`
+	// ConfirmLevel is the level from which the command must be typed
+	// confirmed with "yes"; "high" by default.
+	ConfirmLevel string `json:"confirm_level,omitempty"`
+}
+
+var riskConfig RiskConfig
+
+var builtinRiskRules = []RiskRule{
+	{Name: "rm-root", Category: riskDestructive, Level: "high", Commands: []string{"rm"}, Args: `(^|\s)(/|/\*|~|~/|~/\*|\$HOME|\$HOME/|\$HOME/\*|\*|\.\.|\.\./)(\s|$)`, Message: "deletes the root, home or parent directory"},
+	{Name: "rm-recursive", Category: riskDestructive, Level: "medium", Commands: []string{"rm"}, Args: `(^|\s)(-[a-zA-Z]*[rR]|--recursive)`, Message: "deletes recursively"},
+	{Name: "rm-force", Category: riskDestructive, Level: "medium", Commands: []string{"rm"}, Args: `(^|\s)(-[a-zA-Z]*f|--force)`, Message: "deletes without asking"},
+	{Name: "disk-format", Category: riskDestructive, Level: "high", Commands: []string{"mkfs", "mkfs.*", "mke2fs", "mkswap", "wipefs", "fdisk", "sfdisk", "parted", "shred"}, Message: "formats or wipes a disk"},
+	{Name: "dd-device", Category: riskDestructive, Level: "high", Commands: []string{"dd"}, Args: `(^|\s)of=/dev/`, Message: "writes directly to a device"},
+	{Name: "chmod-chown-root", Category: riskDestructive, Level: "high", Commands: []string{"chmod", "chown", "chgrp"}, Args: `(^|\s)-[a-zA-Z]*R.*\s/(\s|$)`, Message: "changes permissions of the whole filesystem"},
+	{Name: "chmod-world-writable", Category: riskDestructive, Level: "medium", Commands: []string{"chmod"}, Args: `(^|\s)(0?777|a\+w|o\+w)(\s|$)`, Message: "makes files world-writable"},
+	{Name: "find-delete", Category: riskDestructive, Level: "medium", Commands: []string{"find"}, Args: `(^|\s)(-delete|-exec\s+rm)`, Message: "deletes the files it finds"},
+	{Name: "git-discard", Category: riskDestructive, Level: "medium", Commands: []string{"git"}, Args: `^(reset\s.*--hard|clean\s+-[a-zA-Z]*f|checkout\s+(--\s+)?\.$|push\s.*(--force|-f\b)|branch\s+-D)`, Message: "discards git history or uncommitted work"},
+	{Name: "power", Category: riskDestructive, Level: "high", Commands: []string{"shutdown", "reboot", "halt", "poweroff"}, Message: "shuts down or reboots the machine"},
+	{Name: "kill-all", Category: riskDestructive, Level: "medium", Commands: []string{"kill"}, Args: `(^|\s)(-1|1)(\s|$)`, Message: "kills every process it can (or init)"},
+	{Name: "container-prune", Category: riskDestructive, Level: "medium", Commands: []string{"docker", "podman"}, Args: `(system|volume|image|container)\s+prune|(^|\s)rm\s+-f`, Message: "removes containers, images or volumes"},
+	{Name: "sudo", Category: riskPrivilege, Level: "high", Commands: []string{"sudo", "doas", "su", "pkexec", "run0"}, Message: "runs with elevated privileges"},
+	{Name: "network-fetch", Category: riskNetwork, Level: "medium", Commands: []string{"curl", "wget", "aria2c", "fetch", "http", "https", "nc", "ncat", "socat", "scp", "sftp", "ftp"}, Message: "accesses the network"},
+}
+
+// Structural checks that aren't expressed as rules.
+const (
+	checkPipeToShell = "pipe-to-shell"
+	checkExecGen     = "exec-generated-code"
+	checkOutsideCwd  = "write-outside-cwd"
+	checkSystemPath  = "write-system-path"
+	checkUnparsable  = "unparsable"
+)
+
+var shellPrograms = map[string]bool{
+	"sh": true, "bash": true, "zsh": true, "dash": true, "ksh": true, "fish": true, "ash": true,
+	"csh": true, "tcsh": true,
+}
+
+// interpreters read a script from stdin when given no script argument.
+var interpreters = map[string]bool{
+	"python": true, "python3": true, "python2": true, "perl": true, "ruby": true, "node": true, "php": true,
+}
+
+// wrappers run the command given in their arguments.
+var wrappers = map[string]bool{
+	"sudo": true, "doas": true, "pkexec": true, "run0": true, "env": true, "nohup": true,
+	"time": true, "nice": true, "ionice": true, "timeout": true, "stdbuf": true, "xargs": true,
+	"command": true, "exec": true, "builtin": true, "watch": true, "strace": true, "chroot": true,
+}
+
+// wrapperValueFlags are wrapper options that take a separate value.
+var wrapperValueFlags = map[string]bool{
+	"-u": true, "-g": true, "-C": true, "-D": true, "-h": true, "-p": true, "-r": true,
+	"-t": true, "-U": true, "-n": true, "-o": true, "-I": true, "-d": true,
+}
+
+// systemPaths are where writes are treated as high risk.
+var systemPaths = []string{"/etc", "/usr", "/bin", "/sbin", "/lib", "/lib64", "/boot", "/sys", "/proc", "/dev", "/var", "/opt", "/root"}
+
+// harmlessPaths may always be written to.
+var harmlessPaths = map[string]bool{
+	"/dev/null": true, "/dev/stdout": true, "/dev/stderr": true, "/dev/tty": true,
+	"/dev/fd/1": true, "/dev/fd/2": true,
+}
+
+type riskFinding struct {
+	Rule     string
+	Category string
+	Level    riskLevel
+	Message  string
+	Snippet  string // the part of the command that triggered it
+}
+
+type riskAssessment struct {
+	Level    riskLevel
+	Findings []riskFinding
+}
+
+func (a *riskAssessment) add(f riskFinding) {
+	if isRiskCheckDisabled(f.Rule) || f.Level == riskNone {
+		return
+	}
+	for _, existing := range a.Findings {
+		if existing.Rule == f.Rule && existing.Snippet == f.Snippet {
+			return
+		}
+	}
+	a.Findings = append(a.Findings, f)
+	if f.Level > a.Level {
+		a.Level = f.Level
+	}
+}
+
+// confirmLevel is the risk level that requires typing "yes".
+func confirmLevel() riskLevel {
+	if l, ok := parseRiskLevel(riskConfig.ConfirmLevel); ok && riskConfig.ConfirmLevel != "" {
+		return l
+	}
+	return riskHigh
+}
+
+func isRiskCheckDisabled(name string) bool {
+	for _, d := range riskConfig.Disable {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+type compiledRiskRule struct {
+	RiskRule
+	level riskLevel
+	args  *regexp.Regexp
+}
+
+// riskRules merges the built-in rules with the configured ones.
+func riskRules() []compiledRiskRule {
+	var merged []RiskRule
+	index := map[string]int{}
+	for _, r := range append(append([]RiskRule{}, builtinRiskRules...), riskConfig.Rules...) {
+		if i, ok := index[r.Name]; ok && r.Name != "" {
+			merged[i] = r
+			continue
+		}
+		index[r.Name] = len(merged)
+		merged = append(merged, r)
+	}
+
+	var rules []compiledRiskRule
+	for _, r := range merged {
+		if r.Disabled || isRiskCheckDisabled(r.Name) {
+			continue
+		}
+		level, ok := parseRiskLevel(r.Level)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Warning: risk rule %q has unknown level %q, using medium\n", r.Name, r.Level)
+			level = riskMedium
+		}
+		c := compiledRiskRule{RiskRule: r, level: level}
+		if r.Args != "" {
+			re, err := regexp.Compile(r.Args)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: ignoring risk rule %q: %v\n", r.Name, err)
+				continue
+			}
+			c.args = re
+		}
+		rules = append(rules, c)
+	}
+	return rules
+}
+
+// assessCommand parses cmd as a shell script and classifies everything it
+// would run.
+func assessCommand(cmd string) riskAssessment {
+	var a riskAssessment
+	cwd, _ := os.Getwd()
+	assessScript(&a, cmd, riskRules(), cwd, 0)
+	return a
+}
+
+// maxRiskDepth bounds how deep nested "sh -c" strings are parsed.
+const maxRiskDepth = 4
+
+func assessScript(a *riskAssessment, script string, rules []compiledRiskRule, cwd string, depth int) {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(script), "")
+	if err != nil {
+		a.add(riskFinding{Rule: checkUnparsable, Category: riskDestructive, Level: riskMedium, Message: "could not be parsed as a shell command (" + err.Error() + "); review it carefully", Snippet: firstLine(script, 60)})
+		return
+	}
+
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch n := node.(type) {
+		case *syntax.CallExpr:
+			assessCall(a, callArgs(n.Args), n.Args, rules, cwd, depth)
+		case *syntax.BinaryCmd:
+			if n.Op == syntax.Pipe || n.Op == syntax.PipeAll {
+				if call, ok := n.Y.Cmd.(*syntax.CallExpr); ok {
+					args := unwrap(callArgs(call.Args))
+					if len(args) > 0 && readsScriptFromStdin(args) {
+						a.add(riskFinding{Rule: checkPipeToShell, Category: riskPipeToShell, Level: riskHigh, Message: "pipes output into " + args[0] + ", which executes it", Snippet: nodeString(n)})
+					}
+				}
+			}
+		case *syntax.Stmt:
+			for _, r := range n.Redirs {
+				if target, ok := redirectTarget(r); ok {
+					assessWrite(a, target, nodeString(n), cwd)
+				}
+			}
+		}
+		return true
+	})
+}
+
+func assessCall(a *riskAssessment, args []string, words []*syntax.Word, rules []compiledRiskRule, cwd string, depth int) {
+	if len(args) == 0 {
+		return
+	}
+	snippet := strings.Join(args, " ")
+	prog := filepath.Base(args[0])
+	joined := strings.Join(args[1:], " ")
+	for _, r := range rules {
+		if !matchesProgram(r.Commands, prog) {
+			continue
+		}
+		if r.args != nil && !r.args.MatchString(joined) {
+			continue
+		}
+		msg := r.Message
+		if msg == "" {
+			msg = "matches rule " + r.Name
+		}
+		a.add(riskFinding{Rule: r.Name, Category: r.Category, Level: r.level, Message: msg, Snippet: snippet})
+	}
+
+	switch {
+	case shellPrograms[prog] || prog == "su":
+		// sh -c '...' runs a nested script.
+		for i := 1; i < len(args)-1; i++ {
+			if args[i] == "-c" && depth < maxRiskDepth {
+				assessScript(a, args[i+1], rules, cwd, depth+1)
+				break
+			}
+		}
+		if substitutesCode(words) {
+			a.add(riskFinding{Rule: checkExecGen, Category: riskPipeToShell, Level: riskHigh, Message: "runs code produced by another command", Snippet: snippet})
+		}
+	case prog == "eval" || prog == "source" || prog == ".":
+		if substitutesCode(words) {
+			a.add(riskFinding{Rule: checkExecGen, Category: riskPipeToShell, Level: riskHigh, Message: "runs code produced by another command", Snippet: snippet})
+		} else if prog == "eval" && depth < maxRiskDepth {
+			assessScript(a, joined, rules, cwd, depth+1)
+		}
+	case prog == "tee" || prog == "touch" || prog == "mkdir":
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				assessWrite(a, arg, snippet, cwd)
+			}
+		}
+	case prog == "cp" || prog == "mv" || prog == "install" || prog == "ln" || prog == "rsync":
+		if target := lastOperand(args[1:]); target != "" && !strings.Contains(target, ":") {
+			assessWrite(a, target, snippet, cwd)
+		}
+	case prog == "dd":
+		for _, arg := range args[1:] {
+			if strings.HasPrefix(arg, "of=") {
+				assessWrite(a, strings.TrimPrefix(arg, "of="), snippet, cwd)
+			}
+		}
+	case prog == "rm":
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") {
+				assessWrite(a, arg, snippet, cwd)
+			}
+		}
+	}
+
+	if wrappers[prog] {
+		// Peel one wrapper at a time so nested ones like "env sudo" are
+		// classified too.
+		inner := skipWrapperOptions(prog, args[1:])
+		if len(inner) > 0 {
+			assessCall(a, inner, nil, rules, cwd, depth)
+		}
+	}
+}
+
+// assessWrite flags writes to paths outside the working directory.
+func assessWrite(a *riskAssessment, target, snippet, cwd string) {
+	p, ok := resolvePath(target, cwd)
+	if !ok || harmlessPaths[p] {
+		return
+	}
+	if cwd != "" && (p == cwd || strings.HasPrefix(p, cwd+string(filepath.Separator))) {
+		return
+	}
+	if home, err := os.UserHomeDir(); err == nil && home != "/" && (p == home || strings.HasPrefix(p, home+"/")) {
+		a.add(riskFinding{Rule: checkOutsideCwd, Category: riskOutsideCwd, Level: riskMedium, Message: "writes outside the current directory: " + p, Snippet: snippet})
+		return
+	}
+	for _, sys := range systemPaths {
+		if p == sys || strings.HasPrefix(p, sys+"/") {
+			a.add(riskFinding{Rule: checkSystemPath, Category: riskOutsideCwd, Level: riskHigh, Message: "writes to system path " + p, Snippet: snippet})
+			return
+		}
+	}
+	a.add(riskFinding{Rule: checkOutsideCwd, Category: riskOutsideCwd, Level: riskMedium, Message: "writes outside the current directory: " + p, Snippet: snippet})
+}
+
+// resolvePath makes target absolute. Paths that depend on variables or
+// command substitutions can't be resolved statically.
+func resolvePath(target, cwd string) (string, bool) {
+	if target == "" || strings.ContainsAny(target, "$`") {
+		if strings.HasPrefix(target, "$HOME") {
+			if home, err := os.UserHomeDir(); err == nil {
+				return filepath.Clean(home + strings.TrimPrefix(target, "$HOME")), true
+			}
+		}
+		return "", false
+	}
+	if target == "~" || strings.HasPrefix(target, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		target = home + target[1:]
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(cwd, target)
+	}
+	return filepath.Clean(target), true
+}
+
+// redirectTarget returns the file that r writes to, if any. Besides the
+// plain output redirections this covers ">& file", which bash treats like
+// "&> file"; ">&2" and ">&-" only duplicate or close descriptors.
+func redirectTarget(r *syntax.Redirect) (string, bool) {
+	if r.Word == nil {
+		return "", false
+	}
+	target := wordString(r.Word)
+	switch r.Op {
+	case syntax.RdrOut, syntax.AppOut, syntax.RdrAll, syntax.AppAll, syntax.ClbOut, syntax.RdrInOut:
+		return target, true
+	case syntax.DplOut, syntax.DplIn:
+		return target, !isDescriptor(target)
+	}
+	return "", false
+}
+
+// isDescriptor reports whether target names a file descriptor, or "-" to
+// close one, in a ">&" or "<&" redirection.
+func isDescriptor(target string) bool {
+	if target == "-" {
+		return true
+	}
+	target = strings.TrimSuffix(target, "-") // ">&3-" moves the descriptor
+	if target == "" {
+		return false
+	}
+	for _, c := range target {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func matchesProgram(patterns []string, prog string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, prog); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readsScriptFromStdin reports whether args run a shell or interpreter that
+// takes its program from stdin.
+func readsScriptFromStdin(args []string) bool {
+	prog := filepath.Base(args[0])
+	if shellPrograms[prog] {
+		for _, arg := range args[1:] {
+			if arg == "-c" {
+				return false
+			}
+		}
+		return true
+	}
+	if interpreters[prog] {
+		for _, arg := range args[1:] {
+			if arg == "-" {
+				return true
+			}
+			if !strings.HasPrefix(arg, "-") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// substitutesCode reports whether any word embeds a command or process
+// substitution, as in bash <(curl ...) or eval "$(wget ...)".
+func substitutesCode(words []*syntax.Word) bool {
+	found := false
+	for _, w := range words {
+		syntax.Walk(w, func(node syntax.Node) bool {
+			switch node.(type) {
+			case *syntax.CmdSubst, *syntax.ProcSubst:
+				found = true
+			}
+			return !found
+		})
+	}
+	return found
+}
+
+// unwrap strips wrapper programs such as sudo, env or timeout and returns
+// the command they run.
+func unwrap(args []string) []string {
+	for len(args) > 0 && wrappers[filepath.Base(args[0])] {
+		args = skipWrapperOptions(filepath.Base(args[0]), args[1:])
+	}
+	return args
+}
+
+func skipWrapperOptions(prog string, args []string) []string {
+	for len(args) > 0 {
+		a := args[0]
+		switch {
+		case a == "--":
+			return args[1:]
+		case strings.HasPrefix(a, "-"):
+			args = args[1:]
+			if wrapperValueFlags[a] && len(args) > 0 {
+				args = args[1:]
+			}
+		case prog == "env" && strings.Contains(a, "="):
+			args = args[1:]
+		case prog == "timeout":
+			return args[1:] // the first operand is the duration
+		default:
+			return args
+		}
+	}
+	return args
+}
+
+func lastOperand(args []string) string {
+	for i := len(args) - 1; i >= 0; i-- {
+		if !strings.HasPrefix(args[i], "-") {
+			return args[i]
+		}
+	}
+	return ""
+}
+
+func callArgs(words []*syntax.Word) []string {
+	args := make([]string, len(words))
+	for i, w := range words {
+		args[i] = wordString(w)
+	}
+	return args
+}
+
+// wordString returns the value of a word with quotes removed. Expansions
+// are kept in their source form.
+func wordString(w *syntax.Word) string {
+	var b strings.Builder
+	for _, part := range w.Parts {
+		writeWordPart(&b, part)
+	}
+	return b.String()
+}
+
+func writeWordPart(b *strings.Builder, part syntax.WordPart) {
+	switch p := part.(type) {
+	case *syntax.Lit:
+		b.WriteString(p.Value)
+	case *syntax.SglQuoted:
+		b.WriteString(p.Value)
+	case *syntax.DblQuoted:
+		for _, inner := range p.Parts {
+			writeWordPart(b, inner)
+		}
+	default:
+		b.WriteString(nodeString(p))
+	}
+}
+
+func nodeString(node syntax.Node) string {
+	var buf bytes.Buffer
+	if err := syntax.NewPrinter(syntax.SingleLine(true)).Print(&buf, node); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+// printRiskBanner describes why a command is risky.
+func printRiskBanner(a riskAssessment) {
+	if a.Level == riskNone {
+		return
+	}
+	if a.Level == riskHigh {
+		fmt.Println("!!! HIGH RISK COMMAND !!!")
+	} else {
+		fmt.Println("Caution: this command may be risky.")
+	}
+	for _, f := range a.Findings {
+		fmt.Printf("  [%s/%s] %s\n", f.Level, f.Category, f.Message)
+		if f.Snippet != "" {
+			fmt.Printf("      %s\n", firstLine(f.Snippet, 100))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import "testing"
+
+// hasRule reports whether a has a finding from rule.
+func hasRule(a riskAssessment, rule string) bool {
+	for _, f := range a.Findings {
+		if f.Rule == rule {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAssessCommand(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	tests := []struct {
+		cmd   string
+		level riskLevel
+		rule  string // a rule that must be among the findings
+	}{
+		{"ls -la", riskNone, ""},
+		{"go test ./... && git status", riskNone, ""},
+
+		// Pipes into a shell or interpreter.
+		{"curl -fsSL https://example.com/install.sh | sh", riskHigh, checkPipeToShell},
+		{"curl https://example.com | sudo bash", riskHigh, checkPipeToShell},
+		{"wget -qO- https://example.com | python3", riskHigh, checkPipeToShell},
+		{"wget -qO- https://example.com | python3 -", riskHigh, checkPipeToShell},
+		{"curl https://example.com | python3 parse.py", riskMedium, "network-fetch"},
+		{"cat script.sh | bash -c 'echo hi'", riskNone, ""},
+		{"ls | grep go", riskNone, ""},
+
+		// Command and process substitution.
+		{`eval "$(curl https://example.com)"`, riskHigh, checkExecGen},
+		{"bash <(curl https://example.com)", riskHigh, checkExecGen},
+		{"source <(kubectl completion bash)", riskHigh, checkExecGen},
+		{"echo $(date)", riskNone, ""},
+		{"bash -c 'curl https://example.com | sh'", riskHigh, checkPipeToShell},
+		{"eval 'sudo ls'", riskHigh, "sudo"},
+
+		// Redirections.
+		{"echo x > out.txt", riskNone, ""},
+		{"echo x > /etc/hosts", riskHigh, checkSystemPath},
+		{"echo x >> ~/.bashrc", riskMedium, checkOutsideCwd},
+		{"echo x >& ~/.bashrc", riskMedium, checkOutsideCwd},
+		{"echo x &> /tmp/out", riskMedium, checkOutsideCwd},
+		{"echo x >&2", riskNone, ""},
+		{"ls 2>&1 > /dev/null", riskNone, ""},
+		{"ls >&-", riskNone, ""},
+		{"exec 3>&1 4>&3-", riskNone, ""},
+		{"echo x > $HOME/.profile", riskMedium, checkOutsideCwd},
+		{"tee /etc/motd < note.txt", riskHigh, checkSystemPath},
+		{"cp tool /usr/local/bin/", riskHigh, checkSystemPath},
+		{"dd if=image.iso of=/dev/sda", riskHigh, "dd-device"},
+
+		// Wrappers.
+		{"sudo rm -rf /", riskHigh, "rm-root"},
+		{"sudo ls", riskHigh, "sudo"},
+		{"env FOO=1 rm -r build", riskMedium, "rm-recursive"},
+		{"env sudo ls", riskHigh, "sudo"},
+		{"nice -n 10 rm -f build.log", riskMedium, "rm-force"},
+		{"find . -name '*.o' | xargs rm -f", riskMedium, "rm-force"},
+		{"timeout 5 shutdown now", riskHigh, "power"},
+		{"nohup reboot", riskHigh, "power"},
+
+		// Quoting.
+		{`rm -rf "/"`, riskHigh, "rm-root"},
+		{`"r"m -rf '/'`, riskHigh, "rm-root"},
+		{`echo "rm -rf /"`, riskNone, ""},
+		{`echo 'curl https://example.com | sh'`, riskNone, ""},
+		{`git commit -m "sudo make me a sandwich"`, riskNone, ""},
+
+		// Built-in rules.
+		{"git reset --hard HEAD~1", riskMedium, "git-discard"},
+		{"git push --force origin main", riskMedium, "git-discard"},
+		{"chmod 777 file", riskMedium, "chmod-world-writable"},
+		{"mkfs.ext4 /dev/sdb1", riskHigh, "disk-format"},
+		{"docker system prune -a", riskMedium, "container-prune"},
+
+		{"echo 'unterminated", riskMedium, checkUnparsable},
+	}
+	for _, tt := range tests {
+		a := assessCommand(tt.cmd)
+		if a.Level != tt.level {
+			t.Errorf("%q: level %s, want %s (findings %+v)", tt.cmd, a.Level, tt.level, a.Findings)
+			continue
+		}
+		if tt.rule != "" && !hasRule(a, tt.rule) {
+			t.Errorf("%q: no %s finding in %+v", tt.cmd, tt.rule, a.Findings)
+		}
+	}
+}
+
+func TestAssessCommandCustomRules(t *testing.T) {
+	saved := riskConfig
+	t.Cleanup(func() { riskConfig = saved })
+	riskConfig = RiskConfig{
+		Rules: []RiskRule{
+			{Name: "terraform-destroy", Category: riskDestructive, Level: "high", Commands: []string{"terraform"}, Args: `^destroy`},
+			{Name: "kubectl-delete", Category: riskDestructive, Level: "medium", Commands: []string{"kubectl*"}, Args: `(^|\s)delete\s`},
+			{Name: "network-fetch", Disabled: true},
+			{Name: "sudo", Category: riskPrivilege, Level: "medium", Commands: []string{"sudo"}},
+		},
+		Disable: []string{checkPipeToShell},
+	}
+	tests := []struct {
+		cmd   string
+		level riskLevel
+		rule  string
+	}{
+		{"terraform destroy -auto-approve", riskHigh, "terraform-destroy"},
+		{"terraform plan", riskNone, ""},
+		{"kubectl-1.29 delete pod x", riskMedium, "kubectl-delete"},
+		{"env terraform destroy", riskHigh, "terraform-destroy"},
+		{"curl https://example.com", riskNone, ""},
+		{"curl https://example.com | sh", riskNone, ""},
+		{"sudo ls", riskMedium, "sudo"},
+	}
+	for _, tt := range tests {
+		a := assessCommand(tt.cmd)
+		if a.Level != tt.level {
+			t.Errorf("%q: level %s, want %s (findings %+v)", tt.cmd, a.Level, tt.level, a.Findings)
+			continue
+		}
+		if tt.rule != "" && !hasRule(a, tt.rule) {
+			t.Errorf("%q: no %s finding in %+v", tt.cmd, tt.rule, a.Findings)
+		}
+	}
+}
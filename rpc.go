@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Error codes "ask rpc" uses besides those of JSON-RPC itself.
+const (
+	rpcRequestFailed    = -32000 // the model couldn't be asked
+	rpcRequestCancelled = -32800 // cancelled before any answer arrived
+)
+
+// rpcParams are the parameters of "ask rpc" methods; each uses a subset.
+// ID names the request to cancel.
+type rpcParams struct {
+	serveRequest
+	Text  string          `json:"text"`
+	Limit int             `json:"limit"`
+	ID    json.RawMessage `json:"id"`
+}
+
+// handleRPC serves line-delimited JSON-RPC 2.0 on stdin and stdout for
+// editor plugins, until stdin is closed. The methods are:
+//
+//	ask             {prompt, files, input, model} -> answer
+//	refine          {refinement, session, files, input, model} -> answer
+//	cancel          {id} -> {cancelled}
+//	listSessions    {limit} -> [session summary]
+//	extractCommands {text} or {session} -> {commands}
+//
+// While ask or refine runs, the answer is streamed as "delta"
+// notifications with the request's ID and the text that arrived.
+func handleRPC() {
+	out := &rpcWriter{w: os.Stdout}
+	// Stdout carries protocol messages only; anything ask would print for a
+	// person goes to stderr instead.
+	os.Stdout = os.Stderr
+	// Nobody is at a terminal to approve the model's tool calls.
+	toolPrompts = false
+	s := &rpcServer{out: out}
+	readRPCLines(os.Stdin, s.handle)
+	s.calls.wait()
+}
+
+type rpcServer struct {
+	out   *rpcWriter
+	calls rpcCalls
+}
+
+func (s *rpcServer) handle(line []byte) {
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] RPC <- %s\n", line)
+	}
+	var msg rpcMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		s.out.reply(json.RawMessage("null"), nil, &rpcError{Code: rpcParseError, Message: err.Error()})
+		return
+	}
+	if !msg.isRequest() {
+		if msg.Method == "" {
+			s.out.reply(json.RawMessage("null"), nil, &rpcError{Code: rpcInvalidRequest, Message: "no method"})
+		}
+		// Notifications from the client need nothing from ask.
+		return
+	}
+	var params rpcParams
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			s.out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()})
+			return
+		}
+	}
+
+	switch msg.Method {
+	case "ask", "refine":
+		ctx, done := s.calls.start(msg.ID)
+		go func() {
+			defer done()
+			s.answer(ctx, msg, params)
+		}()
+	case "cancel":
+		if len(params.ID) == 0 {
+			s.out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: "id is required"})
+			return
+		}
+		s.out.reply(msg.ID, map[string]bool{"cancelled": s.calls.cancel(params.ID)}, nil)
+	case "listSessions":
+		sessions, err := listSessions()
+		if err != nil {
+			s.out.reply(msg.ID, nil, &rpcError{Code: rpcRequestFailed, Message: err.Error()})
+			return
+		}
+		if params.Limit > 0 && len(sessions) > params.Limit {
+			sessions = sessions[len(sessions)-params.Limit:]
+		}
+		summaries := []sessionSummary{}
+		for _, session := range sessions {
+			summaries = append(summaries, newSessionSummary(session))
+		}
+		s.out.reply(msg.ID, summaries, nil)
+	case "extractCommands":
+		text := params.Text
+		if text == "" {
+			ref := params.Session
+			if ref == "" {
+				ref = "last"
+			}
+			session, err := resolveSession(ref)
+			if err != nil {
+				s.out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()})
+				return
+			}
+			text = session.Answer()
+		}
+		commands := extractCommands(text)
+		if commands == nil {
+			commands = []string{}
+		}
+		s.out.reply(msg.ID, map[string][]string{"commands": commands}, nil)
+	default:
+		s.out.reply(msg.ID, nil, &rpcError{Code: rpcMethodNotFound, Message: "method not found: " + msg.Method})
+	}
+}
+
+// answer runs an ask or refine request, streaming the answer as it arrives.
+// A request cancelled after part of the answer arrived still returns it,
+// marked as interrupted.
+func (s *rpcServer) answer(ctx context.Context, msg rpcMessage, params rpcParams) {
+	out := rpcDeltaWriter{out: s.out, id: msg.ID}
+	var session *Session
+	var err error
+	if msg.Method == "ask" {
+		session, err = askRequest(ctx, params.serveRequest, out)
+	} else {
+		session, err = refineRequest(ctx, params.serveRequest, out)
+	}
+
+	var rerr *requestError
+	switch {
+	case err == nil:
+		s.out.reply(msg.ID, newAnswerResult(session), nil)
+	case errors.As(err, &rerr):
+		s.out.reply(msg.ID, nil, &rpcError{Code: rpcInvalidParams, Message: err.Error()})
+	case ctx.Err() != nil:
+		s.out.reply(msg.ID, nil, &rpcError{Code: rpcRequestCancelled, Message: "request cancelled"})
+	default:
+		s.out.reply(msg.ID, nil, &rpcError{Code: rpcRequestFailed, Message: err.Error()})
+	}
+}
+
+// rpcDeltaWriter sends what is written to it as "delta" notifications for
+// the request with the given ID.
+type rpcDeltaWriter struct {
+	out *rpcWriter
+	id  json.RawMessage
+}
+
+func (w rpcDeltaWriter) Write(p []byte) (int, error) {
+	if err := w.out.notify("delta", map[string]interface{}{"id": w.id, "text": string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// commandResult is what a finished command printed and how it ended.
+type commandResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int // -1 if the command didn't exit normally
+	Duration time.Duration
+	// PTY is set when the command ran on a pseudo-terminal; Stdout then
+	// holds everything it showed there.
+	PTY bool
+}
+
+// Output returns stdout followed by stderr.
+func (r commandResult) Output() string {
+	return r.Stdout + r.Stderr
+}
+
+// shellCommand returns the command that runs cmdStr with sh, inside sb if
+// it is not nil. The command and everything it starts are killed when ctx
+// ends.
+func shellCommand(ctx context.Context, cmdStr string, sb *sandbox) *exec.Cmd {
+	var cmd *exec.Cmd
+	if sb != nil {
+		cmd = sb.command(ctx, cmdStr)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", cmdStr)
+	}
+	prepareCancel(cmd)
+	return cmd
+}
+
+// runCommand runs cmd, showing its stdout and stderr live on ask's own
+// while capturing each of them.
+func runCommand(cmd *exec.Cmd) (commandResult, error) {
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &outBuf)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &errBuf)
+	start := time.Now()
+	err := cmd.Run()
+	res := commandResult{Stdout: outBuf.String(), Stderr: errBuf.String(), ExitCode: -1, Duration: time.Since(start)}
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	return res, err
+}
+
+// runShellCommand runs cmdStr with sh and returns its output. It gives up
+// after commandTimeout or when ctx is cancelled, keeping the output so far.
+func runShellCommand(ctx context.Context, cmdStr string) (string, error) {
+	ctx, cancel := withTimeout(ctx, commandTimeout)
+	defer cancel()
+	res, err := runCommand(shellCommand(ctx, cmdStr, nil))
+	return res.Output(), cancelError(ctx, err, commandTimeout)
+}
+
+// formatDuration renders d the way run statuses show it: "850ms", "3.1s",
+// "2m5.4s".
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
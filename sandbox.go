@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// sandboxMode runs commands extracted from answers in a sandbox (see
+// sandbox_linux.go) instead of directly in the working directory.
+var sandboxMode bool
+
+// Outcomes of a sandboxed run, as recorded in SessionRun.Sandbox.
+const (
+	sandboxUnchanged = "unchanged"
+	sandboxCommitted = "committed"
+	sandboxDiscarded = "discarded"
+)
+
+// maxListedChanges caps how many changed paths are printed after a
+// sandboxed run.
+const maxListedChanges = 50
+
+// sandboxChange is a file or directory a sandboxed command added (A),
+// modified (M) or deleted (D), relative to the working directory.
+type sandboxChange struct {
+	Kind byte
+	Path string
+	// Opaque is set for directories that were deleted and recreated; their
+	// old contents are removed on commit.
+	Opaque bool
+}
+
+func (c sandboxChange) String() string {
+	if c.Opaque {
+		return fmt.Sprintf("%c %s (replaced)", c.Kind, c.Path)
+	}
+	return fmt.Sprintf("%c %s", c.Kind, c.Path)
+}
+
+// reviewSandbox lists what a sandboxed command changed and lets the user
+// apply the changes to the working directory or discard them. It returns
+// the outcome to record for the run.
+func reviewSandbox(sb *sandbox) string {
+	changes, err := sb.changes()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot list sandbox changes, discarding them: %v\n", err)
+		return sandboxDiscarded
+	}
+	if len(changes) == 0 {
+		fmt.Println("The command changed no files.")
+		return sandboxUnchanged
+	}
+
+	fmt.Printf("The command changed %d path(s) in the sandbox:\n", len(changes))
+	for i, c := range changes {
+		if i == maxListedChanges {
+			fmt.Printf("  ... and %d more\n", len(changes)-maxListedChanges)
+			break
+		}
+		fmt.Println("  " + c.String())
+	}
+	fmt.Printf("Apply these changes to %s? [y/N] ", sb.cwd)
+	input, err := readTerminalLine()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCannot confirm, discarding changes: %v\n", err)
+		return sandboxDiscarded
+	}
+	if input != "y" && input != "yes" {
+		fmt.Println("Changes discarded.")
+		return sandboxDiscarded
+	}
+	if err := sb.commit(changes); err != nil {
+		fmt.Fprintf(os.Stderr, "Error applying changes, some may have been applied: %v\n", err)
+		return sandboxDiscarded
+	}
+	fmt.Println("Changes applied.")
+	return sandboxCommitted
+}
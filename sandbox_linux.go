@@ -0,0 +1,377 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sandboxInitArg is the hidden subcommand ask re-executes itself with inside
+// the sandbox's namespaces, to set up the mounts before running the command.
+const sandboxInitArg = "__sandbox-init"
+
+// sandbox runs a command in new user, mount and network namespaces. The
+// working directory is covered by an overlay whose upper layer collects
+// every write, the rest of the filesystem is read-only and there is no
+// network. Nothing reaches the real working directory until commit.
+type sandbox struct {
+	cwd string
+	dir string // holds the overlay's upper and work directories
+}
+
+func newSandbox() (*sandbox, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "ask-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	if dir == cwd || strings.HasPrefix(dir, cwd+"/") {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("the temporary directory %s is inside the working directory; set TMPDIR elsewhere", dir)
+	}
+	sb := &sandbox{cwd: cwd, dir: dir}
+	for _, d := range []string{sb.upper(), sb.work()} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			sb.cleanup()
+			return nil, err
+		}
+	}
+	return sb, nil
+}
+
+func (sb *sandbox) upper() string { return filepath.Join(sb.dir, "upper") }
+func (sb *sandbox) work() string  { return filepath.Join(sb.dir, "work") }
+
+// command re-executes ask as the sandbox's init process, mapped to root in
+// a new user namespace so it may mount.
+func (sb *sandbox) command(ctx context.Context, cmdStr string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "/proc/self/exe", sandboxInitArg, sb.cwd, sb.upper(), sb.work(), cmdStr)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+	return cmd
+}
+
+// sandboxInit runs inside the namespaces: it mounts the overlay over the
+// working directory, makes every other mount read-only, gives the command
+// a private /tmp and then replaces itself with sh.
+func sandboxInit(args []string) {
+	if len(args) != 4 {
+		fmt.Fprintln(os.Stderr, "sandbox: bad arguments")
+		os.Exit(1)
+	}
+	cwd, upper, work, cmdStr := args[0], args[1], args[2], args[3]
+
+	fail := func(what string, err error) {
+		fmt.Fprintf(os.Stderr, "sandbox: %s: %v\n", what, err)
+		os.Exit(1)
+	}
+
+	// Keep the mounts below from propagating back to the host.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fail("making mounts private", err)
+	}
+	// The overlay is mounted before the rest is made read-only, since the
+	// upper directory lives on one of those mounts. userxattr keeps the
+	// overlay's own attributes in the user.* namespace, which is what lets
+	// a user namespace mount it; it needs Linux 5.11, and older kernels
+	// reject it as an unknown option.
+	opts := "lowerdir=" + escapeOverlayPath(cwd) + ",upperdir=" + escapeOverlayPath(upper) + ",workdir=" + escapeOverlayPath(work) + ",userxattr"
+	if err := syscall.Mount("overlay", cwd, "overlay", 0, opts); err != nil {
+		if err == syscall.EINVAL {
+			fail("mounting overlay on "+cwd, fmt.Errorf("%v (the sandbox needs Linux 5.11 or newer)", err))
+		}
+		fail("mounting overlay on "+cwd, err)
+	}
+	if err := remountReadOnly(cwd); err != nil {
+		fail("remounting read-only", err)
+	}
+	if cwd != "/tmp" && !strings.HasPrefix(cwd, "/tmp/") {
+		// Without a private /tmp, temporary files just fail to be written.
+		syscall.Mount("tmpfs", "/tmp", "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777")
+	}
+	// Enter the overlay rather than the directory underneath it.
+	if err := os.Chdir(cwd); err != nil {
+		fail("entering "+cwd, err)
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		fail("finding sh", err)
+	}
+	if err := syscall.Exec(sh, []string{"sh", "-c", cmdStr}, os.Environ()); err != nil {
+		fail("running sh", err)
+	}
+}
+
+// mountEntry is a mount listed in /proc/self/mountinfo.
+type mountEntry struct {
+	point string
+	flags uintptr
+}
+
+// remountReadOnly makes every mount except the overlay at cwd read-only.
+// A user namespace may not clear the flags the host set on a mount, so
+// they are carried over. It fails if any mount the command could reach
+// stays writable.
+func remountReadOnly(cwd string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID parent major:minor root mount-point options ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{unescapeMountPath(fields[4]), mountFlags(fields[5])})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var failed []string
+	for i, m := range mounts {
+		if m.point == cwd || mountHidden(m.point, mounts[i+1:]) {
+			continue
+		}
+		flags := syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY | m.flags
+		if err := syscall.Mount("", m.point, "", flags, ""); err != nil {
+			failed = append(failed, fmt.Sprintf("%s (%v)", m.point, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not make %s read-only", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// mountHidden reports whether a mount at point is covered by one of the
+// mounts made after it, which mountinfo lists later: the same point or a
+// directory above it. A hidden mount can't be reached, so it needn't be
+// read-only; the overlay at cwd hides the mounts below the working
+// directory this way.
+func mountHidden(point string, later []mountEntry) bool {
+	for _, m := range later {
+		if m.point == point || m.point == "/" || strings.HasPrefix(point, m.point+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mountFlags converts the per-mount options in mountinfo to mount flags.
+func mountFlags(opts string) uintptr {
+	var flags uintptr
+	for _, opt := range strings.Split(opts, ",") {
+		switch opt {
+		case "nosuid":
+			flags |= syscall.MS_NOSUID
+		case "nodev":
+			flags |= syscall.MS_NODEV
+		case "noexec":
+			flags |= syscall.MS_NOEXEC
+		case "noatime":
+			flags |= syscall.MS_NOATIME
+		case "nodiratime":
+			flags |= syscall.MS_NODIRATIME
+		case "relatime":
+			flags |= syscall.MS_RELATIME
+		}
+	}
+	return flags
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for a space, ...) the
+// kernel uses in mountinfo.
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// escapeOverlayPath escapes the characters overlayfs treats as separators in
+// its mount options.
+func escapeOverlayPath(p string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`, `:`, `\:`).Replace(p)
+}
+
+// changes lists what the command wrote to the overlay's upper directory:
+// whiteouts (character devices 0/0) are deletions, opaque directories were
+// deleted and recreated, and other entries were added or modified
+// depending on whether they exist underneath.
+func (sb *sandbox) changes() ([]sandboxChange, error) {
+	var changes []sandboxChange
+	upper := sb.upper()
+	err := filepath.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(upper, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		_, lerr := os.Lstat(filepath.Join(sb.cwd, rel))
+		exists := lerr == nil
+
+		switch {
+		case isWhiteout(info):
+			changes = append(changes, sandboxChange{Kind: 'D', Path: rel})
+		case info.IsDir():
+			opaque := isOpaqueDir(path)
+			if !exists || opaque {
+				changes = append(changes, sandboxChange{Kind: 'A', Path: rel + "/", Opaque: opaque && exists})
+			}
+		case exists:
+			changes = append(changes, sandboxChange{Kind: 'M', Path: rel})
+		default:
+			changes = append(changes, sandboxChange{Kind: 'A', Path: rel})
+		}
+		return nil
+	})
+	return changes, err
+}
+
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Rdev == 0
+}
+
+func isOpaqueDir(path string) bool {
+	buf := make([]byte, 1)
+	n, err := syscall.Getxattr(path, "user.overlay.opaque", buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+// commit copies the changes from the upper directory to the real working
+// directory. changes must be in the order returned by changes(), which
+// visits directories before their contents.
+func (sb *sandbox) commit(changes []sandboxChange) error {
+	for _, c := range changes {
+		rel := strings.TrimSuffix(c.Path, "/")
+		src := filepath.Join(sb.upper(), rel)
+		dst := filepath.Join(sb.cwd, rel)
+
+		if c.Kind == 'D' {
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+			continue
+		}
+		info, err := os.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if c.Opaque {
+				if err := os.RemoveAll(dst); err != nil {
+					return err
+				}
+			}
+			if err := os.MkdirAll(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := commitFile(src, dst, info); err != nil {
+			return fmt.Errorf("%s: %w", c.Path, err)
+		}
+	}
+	return nil
+}
+
+// commitFile replaces dst with the file or symlink at src.
+func commitFile(src, dst string, info os.FileInfo) error {
+	if old, err := os.Lstat(dst); err == nil && old.IsDir() {
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		return os.Symlink(target, dst)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("cannot copy %s files", info.Mode().Type())
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Write next to dst and rename, so a failed copy leaves dst intact.
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".ask-sandbox-")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// cleanup removes the sandbox's directories. The kernel leaves a
+// mode-000 directory in the work directory, so permissions are restored
+// first.
+func (sb *sandbox) cleanup() {
+	filepath.Walk(sb.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(sb.dir); err != nil && debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Could not remove sandbox %s: %v\n", sb.dir, err)
+	}
+}
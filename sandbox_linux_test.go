@@ -0,0 +1,29 @@
+//go:build linux
+
+package main
+
+import "testing"
+
+func TestMountHidden(t *testing.T) {
+	later := []mountEntry{{point: "/home/me/src"}, {point: "/mnt/data"}}
+	tests := []struct {
+		point string
+		want  bool
+	}{
+		{"/home/me/src", true},
+		{"/home/me/src/vendor", true},
+		{"/mnt/data/cache", true},
+		{"/home/me/src2", false},
+		{"/home/me", false},
+		{"/mnt", false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		if got := mountHidden(tt.point, later); got != tt.want {
+			t.Errorf("mountHidden(%q) = %v, want %v", tt.point, got, tt.want)
+		}
+	}
+	if !mountHidden("/proc", []mountEntry{{point: "/"}}) {
+		t.Error("a mount under a later mount on / is not hidden")
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+const sandboxInitArg = "__sandbox-init"
+
+// sandbox is only implemented on Linux, where it uses namespaces and
+// overlayfs.
+type sandbox struct {
+	cwd string
+}
+
+var errSandboxUnsupported = errors.New("sandboxed execution is only supported on Linux")
+
+func newSandbox() (*sandbox, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (sb *sandbox) command(ctx context.Context, cmdStr string) *exec.Cmd {
+	return exec.CommandContext(ctx, "sh", "-c", cmdStr)
+}
+
+func (sb *sandbox) changes() ([]sandboxChange, error) {
+	return nil, errSandboxUnsupported
+}
+
+func (sb *sandbox) commit(changes []sandboxChange) error {
+	return errSandboxUnsupported
+}
+
+func (sb *sandbox) cleanup() {}
+
+func sandboxInit(args []string) {
+	fmt.Fprintln(os.Stderr, errSandboxUnsupported)
+	os.Exit(1)
+}
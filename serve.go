@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultServeAddr is where "ask serve" listens unless told otherwise.
+const defaultServeAddr = "127.0.0.1:7860"
+
+// maxServeRequestBytes bounds request bodies; prompts may carry whole logs.
+const maxServeRequestBytes = 32 << 20
+
+// serveMu makes requests that ask the model or change sessions run one at a
+// time, since they share ask's settings.
+var serveMu sync.Mutex
+
+// handleServe serves ask's JSON HTTP API on a Unix socket, if socketPath is
+// set, or on addr, which must be a loopback address. Any local user can
+// connect to a TCP port, so there every request must carry a token that is
+// made at start and written to a file only the user can read. It runs until
+// interrupted.
+func handleServe(addr, socketPath string) {
+	listener, err := serveListener(addr, socketPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	token, tokenPath := "", ""
+	if socketPath == "" {
+		token, tokenPath, err = writeServeToken(listener.Addr())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// Nobody is at a terminal to approve the model's tool calls.
+	toolPrompts = false
+	// Make the client now, so that the first request finds it warm and a
+	// missing key is reported at once.
+	if _, err := cachedProvider(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	srv := &http.Server{Handler: guardLocal(serveMux(), token)}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	fmt.Fprintf(os.Stderr, "Serving the ask API on %s (%s, %s)\n", listener.Addr(), providerName, model)
+	if tokenPath != "" {
+		fmt.Fprintf(os.Stderr, "Send the token in %s with each request as \"Authorization: Bearer <token>\"\n", tokenPath)
+	}
+	err = srv.Serve(listener)
+	if socketPath != "" {
+		os.Remove(socketPath)
+	}
+	if tokenPath != "" {
+		os.Remove(tokenPath)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// writeServeToken makes a random token for a server listening on addr and
+// writes it to ~/.ask/serve-<port>.token, readable only by the user.
+func writeServeToken(addr net.Addr) (token, path string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(buf)
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(homedir, ".ask")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	_, port, _ := net.SplitHostPort(addr.String())
+	path = filepath.Join(dir, "serve-"+port+".token")
+	// A file left by an earlier server is replaced, not reused, so that its
+	// permissions can't carry over.
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		f.Close()
+		return "", "", err
+	}
+	return token, path, f.Close()
+}
+
+// serveListener opens the socket "ask serve" listens on. A socket file left
+// behind by a server that is gone is replaced.
+func serveListener(addr, socketPath string) (net.Listener, error) {
+	if socketPath != "" {
+		if _, err := os.Stat(socketPath); err == nil {
+			if conn, err := net.Dial("unix", socketPath); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("another server is listening on %s", socketPath)
+			}
+			os.Remove(socketPath)
+		}
+		listener, err := net.Listen("unix", socketPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(socketPath, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+	if !isLoopbackHost(addr) {
+		return nil, fmt.Errorf("refusing to listen on %s: only loopback addresses are allowed", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func serveMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", serveHealth)
+	mux.HandleFunc("POST /ask", serveAskRequest)
+	mux.HandleFunc("POST /refine", serveRefineRequest)
+	mux.HandleFunc("GET /sessions", serveSessions)
+	mux.HandleFunc("GET /sessions/{id}", serveSession)
+	mux.HandleFunc("GET /context", serveGetContext)
+	mux.HandleFunc("POST /context", serveAddContext)
+	return mux
+}
+
+// guardLocal rejects requests from other users and from web pages open in
+// a browser. On TCP, where token is set, every request must carry the token
+// and the Host header must name a loopback address, which defeats DNS
+// rebinding. POSTs must have a JSON content type, which browsers only send
+// cross-origin after a preflight that is never answered.
+func guardLocal(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeError(w, http.StatusUnauthorized, errors.New("missing or wrong bearer token"))
+				return
+			}
+			if !isLoopbackHost(r.Host) {
+				writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not a loopback address", r.Host))
+				return
+			}
+		}
+		if r.Method == http.MethodPost && !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("the request body must be JSON (Content-Type: application/json)"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isLoopbackHost reports whether host, with or without a port, is
+// "localhost" or a loopback IP address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveRequest is the body of POST /ask and POST /refine. Input is text
+// attached as context, as if piped into ask.
+type serveRequest struct {
+	Prompt     string   `json:"prompt"`
+	Refinement string   `json:"refinement"`
+	Session    string   `json:"session"`
+	Files      []string `json:"files"`
+	Input      string   `json:"input"`
+	Model      string   `json:"model"`
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "provider": providerName, "model": model})
+}
+
+func serveAskRequest(w http.ResponseWriter, r *http.Request) {
+	var req serveRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	session, err := askRequest(r.Context(), req, ioutil.Discard)
+	if err != nil {
+		writeError(w, requestStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAnswerResult(session))
+}
+
+func serveRefineRequest(w http.ResponseWriter, r *http.Request) {
+	var req serveRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	session, err := refineRequest(r.Context(), req, ioutil.Discard)
+	if err != nil {
+		writeError(w, requestStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAnswerResult(session))
+}
+
+// requestError is a mistake in what a program asked for, as opposed to a
+// failure to answer it. Status is the HTTP status that fits.
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+// requestStatus is the HTTP status for an error from askRequest or
+// refineRequest.
+func requestStatus(err error) int {
+	var rerr *requestError
+	if errors.As(err, &rerr) {
+		return rerr.status
+	}
+	return http.StatusBadGateway
+}
+
+// askRequest asks a question sent by a program ("ask serve", "ask rpc") the
+// way handleAsk does: files and input are attached, context kept with "ask
+// context" is included, and the answer is streamed to out and stored.
+func askRequest(ctx context.Context, req serveRequest, out io.Writer) (*Session, error) {
+	if strings.TrimSpace(req.Prompt) == "" {
+		return nil, &requestError{http.StatusBadRequest, errors.New("prompt is required")}
+	}
+	entries, err := collectAttachments(req.Files)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err}
+	}
+	if strings.TrimSpace(req.Input) != "" {
+		entries = append(entries, stdinContext(req.Input))
+	}
+
+	serveMu.Lock()
+	defer serveMu.Unlock()
+	entries = append(loadPendingContext(), entries...)
+	defer useModel(req.Model)()
+	session, err := askNewSession(ctx, req.Prompt, "", entries, out)
+	if err != nil {
+		return nil, err
+	}
+	clearPendingContext()
+	return session, nil
+}
+
+// refineRequest refines a session for a program the way handleRefine does,
+// streaming the answer to out.
+func refineRequest(ctx context.Context, req serveRequest, out io.Writer) (*Session, error) {
+	if strings.TrimSpace(req.Refinement) == "" {
+		return nil, &requestError{http.StatusBadRequest, errors.New("refinement is required")}
+	}
+	if req.Session == "" {
+		req.Session = "last"
+	}
+	extra, err := collectAttachments(req.Files)
+	if err != nil {
+		return nil, &requestError{http.StatusBadRequest, err}
+	}
+	if strings.TrimSpace(req.Input) != "" {
+		extra = append(extra, stdinContext(req.Input))
+	}
+
+	serveMu.Lock()
+	defer serveMu.Unlock()
+	parent, err := resolveSession(req.Session)
+	if err != nil {
+		return nil, &requestError{http.StatusNotFound, err}
+	}
+	defer useModel(req.Model)()
+	return refineSession(ctx, parent, req.Refinement, extra, out)
+}
+
+// serveSessions lists stored sessions, oldest first; ?limit=N keeps the N
+// most recent.
+func serveSessions(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+		limit = n
+	}
+	sessions, err := listSessions()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if limit > 0 && len(sessions) > limit {
+		sessions = sessions[len(sessions)-limit:]
+	}
+	summaries := []sessionSummary{}
+	for _, s := range sessions {
+		summaries = append(summaries, newSessionSummary(s))
+	}
+	writeJSON(w, http.StatusOK, summaries)
+}
+
+// serveSession returns a whole session as stored; the ID may be a unique
+// prefix or "last".
+func serveSession(w http.ResponseWriter, r *http.Request) {
+	s, err := resolveSession(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// contextResponse lists the context that will be sent next: with the last
+// session's next refinement, or with the next question if SessionID is
+// empty.
+type contextResponse struct {
+	SessionID string         `json:"session_id,omitempty"`
+	Entries   []ContextEntry `json:"entries"`
+}
+
+func serveGetContext(w http.ResponseWriter, r *http.Request) {
+	resp := contextResponse{Entries: []ContextEntry{}}
+	if s, err := getLastSession(); err == nil {
+		resp.SessionID = s.ID
+		resp.Entries = append(resp.Entries, s.pendingContext()...)
+	} else {
+		resp.Entries = append(resp.Entries, loadPendingContext()...)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// serveAddContext adds the output of a command or a set of files as
+// context, like "ask context" and "ask context -f". A command that fails
+// still has its output added; the failure is reported with it.
+func serveAddContext(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Command string   `json:"command"`
+		Files   []string `json:"files"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if (req.Command == "") == (len(req.Files) == 0) {
+		writeError(w, http.StatusBadRequest, errors.New("give either command or files"))
+		return
+	}
+
+	serveMu.Lock()
+	defer serveMu.Unlock()
+	var entries []ContextEntry
+	var cmdErr error
+	if req.Command != "" {
+		ctx, cancel := withTimeout(r.Context(), commandTimeout)
+		defer cancel()
+		output, err := shellCommand(ctx, req.Command, nil).CombinedOutput()
+		cmdErr = cancelError(ctx, err, commandTimeout)
+		entries = append(entries, ContextEntry{Kind: "command", Source: req.Command, Content: string(output), Time: time.Now()})
+	} else {
+		attached, err := collectAttachments(req.Files)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		entries = attached
+	}
+	session, err := addContextEntries(entries)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := map[string]interface{}{"entries": entries}
+	if session != nil {
+		resp["session_id"] = session.ID
+	}
+	if cmdErr != nil {
+		resp["error"] = "command failed: " + cmdErr.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// readJSON decodes the request body into v, answering the request with an
+// error and returning false if it can't.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] %s %s\n", r.Method, r.URL.Path)
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxServeRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGuardLocal(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		token  string
+		auth   string
+		host   string
+		method string
+		ctype  string
+		want   int
+	}{
+		{"tcp with token", "secret", "Bearer secret", "127.0.0.1:7860", "GET", "", http.StatusOK},
+		{"tcp without token", "secret", "", "127.0.0.1:7860", "GET", "", http.StatusUnauthorized},
+		{"tcp with wrong token", "secret", "Bearer wrong", "127.0.0.1:7860", "GET", "", http.StatusUnauthorized},
+		{"tcp with bare token", "secret", "secret", "127.0.0.1:7860", "GET", "", http.StatusUnauthorized},
+		{"tcp POST command without token", "secret", "", "127.0.0.1:7860", "POST", "application/json", http.StatusUnauthorized},
+		{"tcp rebound host", "secret", "Bearer secret", "evil.example:7860", "GET", "", http.StatusForbidden},
+		{"tcp POST form", "secret", "Bearer secret", "localhost:7860", "POST", "text/plain", http.StatusUnsupportedMediaType},
+		{"socket", "", "", "localhost", "GET", "", http.StatusOK},
+		{"socket POST form", "", "", "localhost", "POST", "text/plain", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://"+tt.host+"/context", strings.NewReader("{}"))
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if tt.ctype != "" {
+			r.Header.Set("Content-Type", tt.ctype)
+		}
+		w := httptest.NewRecorder()
+		guardLocal(ok, tt.token).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	sessionFileName   = "session.json"
+	sessionTimeLayout = "20060102-150405"
+)
+
+// Session is one answer from the model together with the conversation that
+// led to it. Refinements are stored as child sessions that carry the full
+// history and point back at their parent.
+type Session struct {
+	ID       string                         `json:"id"`
+	ParentID string                         `json:"parent_id,omitempty"`
+	Created  time.Time                      `json:"created"`
+	Updated  time.Time                      `json:"updated"`
+	Provider string                         `json:"provider,omitempty"`
+	Model    string                         `json:"model"`
+	Params   SessionParams                  `json:"params"`
+	Messages []openai.ChatCompletionMessage `json:"messages"`
+	Usage    SessionUsage                   `json:"usage"`
+	Runs     []SessionRun                   `json:"runs,omitempty"`
+	Context  []ContextEntry                 `json:"context,omitempty"`
+	// ToolCalls lists the tools the model called while answering. The
+	// calls and their results are also part of Messages.
+	ToolCalls []SessionToolCall `json:"tool_calls,omitempty"`
+
+	// Legacy is set for sessions read from the pre-session.json layout.
+	Legacy bool `json:"legacy,omitempty"`
+
+	// Interrupted is set when the last answer was cut short by Ctrl+C or a
+	// timeout.
+	Interrupted bool `json:"interrupted,omitempty"`
+
+	// Truncated is set when the last answer stopped at the model's output
+	// token limit.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// ContextTrimmed is set when context, or the question itself, was cut
+	// to fit the prompt budget of the last turn.
+	ContextTrimmed bool `json:"context_trimmed,omitempty"`
+
+	// instruction is added to the system prompt while answering, as with
+	// -code. It is not stored, so a refinement doesn't repeat it.
+	instruction string
+
+	dir string
+}
+
+type SessionParams struct {
+	MaxTokens int `json:"max_tokens,omitempty"`
+}
+
+// SessionUsage accumulates token usage reported by the provider.
+type SessionUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// SessionRun records a command run from the session's answer.
+type SessionRun struct {
+	Command string `json:"command"`
+	// Output is the command's stdout; runs recorded before stderr was
+	// captured separately have both merged here.
+	Output string `json:"output"`
+	Stderr string `json:"stderr,omitempty"`
+	// PTY is set for runs on a pseudo-terminal, whose Output is a
+	// transcript of the terminal with stdout and stderr interleaved.
+	PTY bool `json:"pty,omitempty"`
+	// Check is set for runs of the check command of "ask until", which the
+	// user gave rather than the model.
+	Check bool `json:"check,omitempty"`
+	// ExitCode is nil if the command didn't exit normally (it was killed,
+	// or couldn't be started) and for runs from older versions.
+	ExitCode   *int  `json:"exit_code,omitempty"`
+	DurationMS int64 `json:"duration_ms,omitempty"`
+	// Error says why a command without an exit code ended.
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+	// Sandbox is set for sandboxed runs: "unchanged", "committed" or
+	// "discarded", depending on what happened to the files it changed.
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// Status describes how the run ended, e.g. "exit code 2 after 3.1s" or
+// "interrupted after 850ms". It is empty for runs from older versions.
+func (r SessionRun) Status() string {
+	var status string
+	switch {
+	case r.ExitCode != nil:
+		status = fmt.Sprintf("exit code %d", *r.ExitCode)
+	case r.Error != "" && r.DurationMS > 0:
+		status = r.Error
+	default:
+		return ""
+	}
+	return status + " after " + formatDuration(time.Duration(r.DurationMS)*time.Millisecond)
+}
+
+// sandboxNote tells the model what became of a sandboxed run's changes.
+func (r SessionRun) sandboxNote() string {
+	switch r.Sandbox {
+	case sandboxCommitted:
+		return "Ran in a sandbox; its file changes were applied.\n"
+	case sandboxDiscarded:
+		return "Ran in a sandbox; its file changes were discarded.\n"
+	case sandboxUnchanged:
+		return "Ran in a sandbox; it changed no files.\n"
+	}
+	return ""
+}
+
+// SessionToolCall records one call the model made to a local tool.
+type SessionToolCall struct {
+	Tool      string `json:"tool"`
+	Arguments string `json:"arguments"`
+	// Approval is "allowed" (by policy), "approved" (by the user) or
+	// "denied"; it is empty for calls to unknown tools.
+	Approval   string    `json:"approval,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// ContextEntry is a piece of extra context: the output of a command, or a
+// blob of text carried over from the old text-file layout.
+type ContextEntry struct {
+	Kind    string    `json:"kind"`             // "command", "file", "stdin" or "legacy"
+	Source  string    `json:"source,omitempty"` // the command or file path that produced it
+	Content string    `json:"content"`
+	Time    time.Time `json:"time"`
+	// Language is the code fence language of attached files.
+	Language string `json:"language,omitempty"`
+	// Included is set when the entry was already sent to the model as part
+	// of this session's messages, so refinements don't send it again.
+	Included bool `json:"included,omitempty"`
+	// Trimmed is set when the entry didn't fit the prompt budget.
+	Trimmed string `json:"trimmed,omitempty"` // "partial" or "dropped"
+}
+
+const (
+	trimmedPartial = "partial"
+	trimmedDropped = "dropped"
+)
+
+func (e ContextEntry) Format() string {
+	return e.header() + e.Content + e.footer()
+}
+
+// header and footer frame the content when it is sent to the model.
+func (e ContextEntry) header() string {
+	switch e.Kind {
+	case "command":
+		return "\n---\nCommand: " + e.Source + "\n"
+	case "stdin":
+		return "\n---\nInput from stdin:\n"
+	case "file":
+		return "\n---\nFile: " + e.Source + "\n```" + e.Language + "\n"
+	}
+	return ""
+}
+
+func (e ContextEntry) footer() string {
+	switch e.Kind {
+	case "file":
+		return "\n```\n"
+	case "legacy":
+		return ""
+	}
+	return "\n"
+}
+
+func formatContext(entries []ContextEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(e.Format())
+	}
+	return b.String()
+}
+
+func formatRuns(runs []SessionRun) string {
+	var b strings.Builder
+	for _, item := range runItems(runs) {
+		b.WriteString(item.Text())
+	}
+	return b.String()
+}
+
+// newSession starts a session for messages. parent may be nil.
+func newSession(messages []openai.ChatCompletionMessage, parent *Session) *Session {
+	now := time.Now()
+	s := &Session{
+		Created:  now,
+		Updated:  now,
+		Provider: providerName,
+		Model:    model,
+		Params:   SessionParams{MaxTokens: promptBudget()},
+		Messages: messages,
+	}
+	if parent != nil {
+		s.ParentID = parent.ID
+	}
+	return s
+}
+
+func (s *Session) Dir() string {
+	return s.dir
+}
+
+func (s *Session) addUsage(u openai.Usage) {
+	s.Usage.PromptTokens += u.PromptTokens
+	s.Usage.CompletionTokens += u.CompletionTokens
+	s.Usage.TotalTokens += u.TotalTokens
+}
+
+// FirstPrompt returns the user message that started the conversation.
+func (s *Session) FirstPrompt() string {
+	for _, m := range s.Messages {
+		if m.Role == openai.ChatMessageRoleUser {
+			return m.Content
+		}
+	}
+	return ""
+}
+
+// LastPrompt returns the most recent user message.
+func (s *Session) LastPrompt() string {
+	for i := len(s.Messages) - 1; i >= 0; i-- {
+		if s.Messages[i].Role == openai.ChatMessageRoleUser {
+			return s.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// Answer returns the last assistant message.
+func (s *Session) Answer() string {
+	for i := len(s.Messages) - 1; i >= 0; i-- {
+		if s.Messages[i].Role == openai.ChatMessageRoleAssistant {
+			return s.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// pendingContext returns the context entries not yet sent to the model.
+func (s *Session) pendingContext() []ContextEntry {
+	var entries []ContextEntry
+	for _, e := range s.Context {
+		if !e.Included {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func sessionsDir() (string, error) {
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homedir, historyDirName), nil
+}
+
+// newSessionID returns a sortable ID: the creation time followed by a random
+// suffix so that sessions created in the same second don't collide.
+func newSessionID(t time.Time) string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		// Fall back to the sub-second part of the clock.
+		return t.Format(sessionTimeLayout) + fmt.Sprintf("-%06d", t.Nanosecond()/1000)
+	}
+	return t.Format(sessionTimeLayout) + "-" + hex.EncodeToString(suffix)
+}
+
+// createSession assigns s an ID, creates its directory and saves it.
+func createSession(s *Session) error {
+	dir, err := sessionsDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		id := newSessionID(s.Created)
+		err := os.Mkdir(filepath.Join(dir, id), 0755)
+		if err == nil {
+			s.ID = id
+			s.dir = filepath.Join(dir, id)
+			break
+		}
+		if !os.IsExist(err) || attempt >= 5 {
+			return err
+		}
+	}
+
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Storing session in: %s\n", s.dir)
+	}
+	return saveSession(s)
+}
+
+// saveSession writes session.json. Legacy sessions are upgraded in place.
+func saveSession(s *Session) error {
+	if s.dir == "" {
+		return errors.New("session has no directory")
+	}
+	s.Updated = time.Now()
+	s.Legacy = false
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, sessionFileName+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, sessionFileName))
+}
+
+func loadSession(id string) (*Session, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	return loadSessionDir(filepath.Join(dir, id))
+}
+
+func loadSessionDir(dir string) (*Session, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, sessionFileName))
+	if os.IsNotExist(err) {
+		return loadLegacySession(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, sessionFileName), err)
+	}
+	s.dir = dir
+	return &s, nil
+}
+
+// loadLegacySession reads a session directory written before session.json
+// existed: prompt.txt, response.txt, original_prompt.txt and optionally
+// messages.json, run_output.txt and context.txt.
+func loadLegacySession(dir string) (*Session, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a session directory", dir)
+	}
+
+	s := &Session{ID: filepath.Base(dir), Legacy: true, dir: dir}
+	if t, err := time.ParseInLocation(sessionTimeLayout, s.ID, time.Local); err == nil {
+		s.Created = t
+	} else {
+		s.Created = info.ModTime()
+	}
+	s.Updated = info.ModTime()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "messages.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &s.Messages); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(dir, "messages.json"), err)
+		}
+	} else {
+		prompt := readFileIfExists(filepath.Join(dir, "original_prompt.txt"))
+		if prompt == "" {
+			prompt = readFileIfExists(filepath.Join(dir, "prompt.txt"))
+		}
+		response := readFileIfExists(filepath.Join(dir, "response.txt"))
+		if prompt == "" && response == "" {
+			return nil, fmt.Errorf("%s is not a session directory", dir)
+		}
+		s.Messages = []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+			{Role: openai.ChatMessageRoleAssistant, Content: response},
+		}
+	}
+
+	if out := readFileIfExists(filepath.Join(dir, "run_output.txt")); out != "" {
+		s.Runs = append(s.Runs, SessionRun{Output: out, Time: s.Updated})
+	}
+	if ctx := readFileIfExists(filepath.Join(dir, "context.txt")); ctx != "" {
+		s.Context = append(s.Context, ContextEntry{Kind: "legacy", Content: ctx, Time: s.Updated})
+	}
+	return s, nil
+}
+
+// listSessions returns all readable sessions, oldest first.
+func listSessions() ([]*Session, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var sessions []*Session
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		s, err := loadSessionDir(filepath.Join(dir, f.Name()))
+		if err != nil {
+			if debugMode {
+				fmt.Fprintf(os.Stderr, "[DEBUG] Skipping session %s: %v\n", f.Name(), err)
+			}
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if !sessions[i].Created.Equal(sessions[j].Created) {
+			return sessions[i].Created.Before(sessions[j].Created)
+		}
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions, nil
+}
+
+// resolveSession finds a session by "last", its full ID, or a unique
+// prefix of its ID.
+func resolveSession(ref string) (*Session, error) {
+	if ref == "last" {
+		return getLastSession()
+	}
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(ref, `/\`) || ref == "." || ref == ".." || ref == "" {
+		return nil, fmt.Errorf("invalid session ID %q", ref)
+	}
+	if info, err := os.Stat(filepath.Join(dir, ref)); err == nil && info.IsDir() {
+		return loadSessionDir(filepath.Join(dir, ref))
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var matches []string
+	for _, f := range files {
+		if f.IsDir() && strings.HasPrefix(f.Name(), ref) {
+			matches = append(matches, f.Name())
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no session matches %q", ref)
+	case 1:
+		return loadSessionDir(filepath.Join(dir, matches[0]))
+	default:
+		if len(matches) > 5 {
+			matches = append(matches[:5], "...")
+		}
+		return nil, fmt.Errorf("%q is ambiguous, it matches several sessions: %s", ref, strings.Join(matches, ", "))
+	}
+}
+
+func removeSession(s *Session) error {
+	if s.dir == "" {
+		return errors.New("session has no directory")
+	}
+	return os.RemoveAll(s.dir)
+}
+
+// getLastSession returns the newest session. Session IDs start with their
+// creation time, so only the sessions of the newest second are read, not
+// the whole history.
+func getLastSession() (*Session, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Group the session directories by the second they were created in.
+	bySecond := map[string][]string{}
+	var seconds []string
+	for _, f := range files {
+		name := f.Name()
+		if !f.IsDir() || len(name) < len(sessionTimeLayout) {
+			continue
+		}
+		second := name[:len(sessionTimeLayout)]
+		if _, err := time.Parse(sessionTimeLayout, second); err != nil {
+			continue
+		}
+		if bySecond[second] == nil {
+			seconds = append(seconds, second)
+		}
+		bySecond[second] = append(bySecond[second], name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(seconds)))
+
+	for _, second := range seconds {
+		var last *Session
+		for _, name := range bySecond[second] {
+			s, err := loadSessionDir(filepath.Join(dir, name))
+			if err != nil {
+				if debugMode {
+					fmt.Fprintf(os.Stderr, "[DEBUG] Skipping session %s: %v\n", name, err)
+				}
+				continue
+			}
+			if last == nil || s.Created.After(last.Created) || (s.Created.Equal(last.Created) && s.ID > last.ID) {
+				last = s
+			}
+		}
+		if last != nil {
+			if debugMode {
+				fmt.Fprintf(os.Stderr, "[DEBUG] Last session path: %s\n", last.dir)
+			}
+			return last, nil
+		}
+	}
+	return nil, errors.New("no previous sessions found")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// useTempHome points the session store at an empty temporary HOME and
+// returns the sessions directory.
+func useTempHome(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir, err := sessionsDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestSession(t *testing.T, created time.Time, prompt string) *Session {
+	t.Helper()
+	s := &Session{
+		Created: created,
+		Model:   "gpt-4o",
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+			{Role: openai.ChatMessageRoleAssistant, Content: "answer to " + prompt},
+		},
+	}
+	if err := createSession(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLoadLegacySession(t *testing.T) {
+	dir := useTempHome(t)
+	writeFiles(t, filepath.Join(dir, "20240102-030405"), map[string]string{
+		"prompt.txt":          "the prompt with context",
+		"original_prompt.txt": "how do I list files?",
+		"response.txt":        "```sh\nls -la\n```",
+		"run_output.txt":      "total 0",
+		"context.txt":         "$ pwd\n/home/me",
+	})
+
+	s, err := resolveSession("20240102")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Legacy || s.ID != "20240102-030405" {
+		t.Errorf("session = %s, legacy %v", s.ID, s.Legacy)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local); !s.Created.Equal(want) {
+		t.Errorf("created = %v, want %v from the ID", s.Created, want)
+	}
+	if s.FirstPrompt() != "how do I list files?" || s.Answer() != "```sh\nls -la\n```" {
+		t.Errorf("prompt %q, answer %q; want the original prompt and the response", s.FirstPrompt(), s.Answer())
+	}
+	if len(s.Runs) != 1 || s.Runs[0].Output != "total 0" {
+		t.Errorf("runs = %+v", s.Runs)
+	}
+	if len(s.Context) != 1 || s.Context[0].Kind != "legacy" || s.Context[0].Content != "$ pwd\n/home/me" {
+		t.Errorf("context = %+v", s.Context)
+	}
+
+	// Saving upgrades the session to session.json in place.
+	if err := saveSession(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, s.ID, sessionFileName)); err != nil {
+		t.Fatalf("no %s after saving: %v", sessionFileName, err)
+	}
+	s, err = loadSession(s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Legacy || s.FirstPrompt() != "how do I list files?" || len(s.Runs) != 1 {
+		t.Errorf("upgraded session = %+v", s)
+	}
+}
+
+func TestLoadLegacySessionVariants(t *testing.T) {
+	dir := useTempHome(t)
+
+	// A conversation was kept in messages.json, and the directory name isn't
+	// a time, so the modification time is used.
+	writeFiles(t, filepath.Join(dir, "refined"), map[string]string{
+		"messages.json": `[{"role":"user","content":"q1"},{"role":"assistant","content":"a1"},` +
+			`{"role":"user","content":"q2"},{"role":"assistant","content":"a2"}]`,
+		"response.txt": "ignored",
+	})
+	s, err := loadSession("refined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Messages) != 4 || s.Answer() != "a2" || s.Created.IsZero() {
+		t.Errorf("session from messages.json = %+v", s)
+	}
+
+	// Only prompt.txt, as written before original_prompt.txt existed.
+	writeFiles(t, filepath.Join(dir, "20230101-000000"), map[string]string{"prompt.txt": "old question"})
+	if s, err := loadSession("20230101-000000"); err != nil || s.FirstPrompt() != "old question" || s.Answer() != "" {
+		t.Errorf("prompt-only session = %+v, %v", s, err)
+	}
+
+	writeFiles(t, filepath.Join(dir, "empty"), nil)
+	if _, err := loadSession("empty"); err == nil {
+		t.Error("an empty directory loaded as a session")
+	}
+	writeFiles(t, filepath.Join(dir, "broken"), map[string]string{"messages.json": "{"})
+	if _, err := loadSession("broken"); err == nil {
+		t.Error("a session with a corrupt messages.json loaded")
+	}
+}
+
+func TestGetLastSession(t *testing.T) {
+	dir := useTempHome(t)
+	if _, err := getLastSession(); err == nil {
+		t.Error("found a last session in an empty history")
+	}
+
+	base := time.Date(2025, 6, 1, 12, 0, 0, 0, time.Local)
+	newTestSession(t, base.Add(-time.Hour), "an hour ago")
+	// Several sessions in the same second: the latest Created wins, not
+	// the largest random ID suffix.
+	latest := newTestSession(t, base.Add(900*time.Millisecond), "latest")
+	newTestSession(t, base.Add(100*time.Millisecond), "earlier in the same second")
+	newTestSession(t, base.Add(500*time.Millisecond), "middle of the same second")
+
+	// Things in the sessions directory that aren't sessions are ignored.
+	writeFiles(t, filepath.Join(dir, "notes"), map[string]string{"todo.txt": "not a session"})
+	writeFiles(t, dir, map[string]string{"29990101-000000-file": "a file, not a directory"})
+
+	last, err := getLastSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.ID != latest.ID {
+		t.Errorf("last session = %s (%q), want %s", last.ID, last.FirstPrompt(), latest.ID)
+	}
+
+	// An unreadable session in a newer second falls back to the newest
+	// readable one.
+	writeFiles(t, filepath.Join(dir, base.Add(time.Minute).Format(sessionTimeLayout)+"-bad"), map[string]string{sessionFileName: "{"})
+	if last, err := getLastSession(); err != nil || last.ID != latest.ID {
+		t.Errorf("with a corrupt newer session, last = %v, %v; want %s", last, err, latest.ID)
+	}
+
+	// A legacy session is found by its directory name too.
+	legacyID := base.Add(2 * time.Minute).Format(sessionTimeLayout)
+	writeFiles(t, filepath.Join(dir, legacyID), map[string]string{"prompt.txt": "legacy", "response.txt": "old answer"})
+	last, err = getLastSession()
+	if err != nil || last.ID != legacyID || !last.Legacy {
+		t.Errorf("last = %v, %v; want the legacy session %s", last, err, legacyID)
+	}
+
+	// The result agrees with reading the whole history.
+	all, err := listSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := all[len(all)-1]; last.ID != want.ID {
+		t.Errorf("getLastSession = %s, listSessions ends with %s", last.ID, want.ID)
+	}
+	if last, err := resolveSession("last"); err != nil || last.ID != legacyID {
+		t.Errorf(`resolveSession("last") = %v, %v`, last, err)
+	}
+}
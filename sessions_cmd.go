@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+func handleSessions(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `Usage:
+  ask sessions list [-n N]                 List stored sessions (newest last)
+  ask sessions show <id>                   Show a session's conversation, runs and context
+  ask sessions grep [-i] <pattern>         Search prompts, answers, runs and context
+  ask sessions rm <id>...                  Delete sessions
+  ask sessions prune -older-than <age>     Delete sessions older than e.g. 30d, 2w or 12h
+
+list, show and grep take -o json or -o jsonl for output for programs.
+
+Session IDs may be abbreviated to a unique prefix; "last" is the newest session.
+`)
+	}
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "list", "ls":
+		listCmd := flag.NewFlagSet("sessions list", flag.ExitOnError)
+		limit := listCmd.Int("n", 20, "number of sessions to show (0 for all)")
+		output := listCmd.String("o", "", outputUsage)
+		listCmd.Parse(args[1:])
+		setOutputFormat(*output)
+		handleSessionsList(*limit)
+
+	case "show":
+		showCmd := flag.NewFlagSet("sessions show", flag.ExitOnError)
+		output := showCmd.String("o", "", outputUsage)
+		showCmd.Parse(args[1:])
+		if showCmd.NArg() < 1 {
+			fmt.Fprintln(os.Stderr, "Usage: ask sessions show [-o json] <id>")
+			os.Exit(1)
+		}
+		setOutputFormat(*output)
+		s, err := resolveSession(showCmd.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if outputFormat != outputText {
+			printJSON(s)
+			return
+		}
+		printSession(s)
+
+	case "grep", "search":
+		grepCmd := flag.NewFlagSet("sessions grep", flag.ExitOnError)
+		ignoreCase := grepCmd.Bool("i", false, "case-insensitive match")
+		output := grepCmd.String("o", "", outputUsage)
+		grepCmd.Parse(args[1:])
+		setOutputFormat(*output)
+		if grepCmd.NArg() < 1 {
+			fmt.Fprintln(os.Stderr, "Usage: ask sessions grep [-i] <pattern>")
+			os.Exit(1)
+		}
+		pattern := strings.Join(grepCmd.Args(), " ")
+		if *ignoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid pattern: %v\n", err)
+			os.Exit(1)
+		}
+		if !handleSessionsGrep(re) {
+			os.Exit(1)
+		}
+
+	case "rm", "delete":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "Usage: ask sessions rm <id>...")
+			os.Exit(1)
+		}
+		failed := false
+		for _, ref := range args[1:] {
+			s, err := resolveSession(ref)
+			if err == nil {
+				err = removeSession(s)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", ref, err)
+				failed = true
+				continue
+			}
+			fmt.Println("Removed session", s.ID)
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+	case "prune":
+		pruneCmd := flag.NewFlagSet("sessions prune", flag.ExitOnError)
+		olderThan := pruneCmd.String("older-than", "", "delete sessions older than this age (e.g. 30d, 2w, 12h)")
+		dryRun := pruneCmd.Bool("dry-run", false, "only list the sessions that would be deleted")
+		pruneCmd.Parse(args[1:])
+		if *olderThan == "" {
+			fmt.Fprintln(os.Stderr, "Usage: ask sessions prune -older-than <age> [-dry-run]")
+			os.Exit(1)
+		}
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid age: %v\n", err)
+			os.Exit(1)
+		}
+		handleSessionsPrune(age, *dryRun)
+
+	case "-h", "--help", "help":
+		usage()
+
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown sessions command '%s'.\n", args[0])
+		usage()
+		os.Exit(1)
+	}
+}
+
+func handleSessionsList(limit int) {
+	sessions, err := listSessions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing sessions: %v\n", err)
+		os.Exit(1)
+	}
+	if limit > 0 && len(sessions) > limit {
+		sessions = sessions[len(sessions)-limit:]
+	}
+	if outputFormat != outputText {
+		var records []interface{}
+		for _, s := range sessions {
+			records = append(records, newSessionSummary(s))
+		}
+		printRecords(records)
+		return
+	}
+	if len(sessions) == 0 {
+		fmt.Println("No sessions stored yet.")
+		return
+	}
+
+	writeSessionTable(os.Stdout, sessions)
+}
+
+// writeSessionTable lists sessions to out, one line each, marking
+// refinements and interrupted answers.
+func writeSessionTable(out io.Writer, sessions []*Session) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tMODEL\tAGE\tPROMPT")
+	for _, s := range sessions {
+		m := s.Model
+		if m == "" {
+			m = "-"
+		}
+		id := s.ID
+		if s.ParentID != "" {
+			id += " ↳" // refinement of another session
+		}
+		if s.Interrupted {
+			id += " !" // answer cut short
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", id, m, formatAge(time.Since(s.Created)), firstLine(s.FirstPrompt(), 60))
+	}
+	w.Flush()
+}
+
+func printSession(s *Session) {
+	fmt.Printf("ID:       %s\n", s.ID)
+	if s.ParentID != "" {
+		fmt.Printf("Parent:   %s\n", s.ParentID)
+	}
+	fmt.Printf("Created:  %s (%s ago)\n", s.Created.Format(time.RFC3339), formatAge(time.Since(s.Created)))
+	if s.Provider != "" || s.Model != "" {
+		fmt.Printf("Model:    %s %s\n", s.Provider, s.Model)
+	}
+	if s.Usage.TotalTokens > 0 {
+		fmt.Printf("Usage:    %d prompt + %d completion = %d tokens\n", s.Usage.PromptTokens, s.Usage.CompletionTokens, s.Usage.TotalTokens)
+	}
+	fmt.Printf("Path:     %s\n", s.Dir())
+	if s.Legacy {
+		fmt.Println("Format:   legacy (text files)")
+	}
+	if s.Interrupted {
+		fmt.Println("Status:   interrupted (the last answer is incomplete)")
+	}
+
+	for _, m := range s.Messages {
+		if m.Role == openai.ChatMessageRoleTool {
+			continue // results are shown with the tool calls below
+		}
+		if m.Content != "" || len(m.ToolCalls) == 0 {
+			fmt.Printf("\n=== %s ===\n%s\n", strings.ToUpper(m.Role), strings.TrimRight(m.Content, "\n"))
+		}
+		for _, call := range m.ToolCalls {
+			fmt.Printf("\n=== TOOL CALL ===\n%s %s\n", call.Function.Name, call.Function.Arguments)
+		}
+	}
+	for _, c := range s.ToolCalls {
+		fmt.Printf("\n=== TOOL %s %s ===\n", c.Tool, c.Time.Format(time.RFC3339))
+		fmt.Printf("Arguments: %s\n", c.Arguments)
+		if c.Approval != "" {
+			fmt.Printf("Approval: %s\n", c.Approval)
+		}
+		if c.Error != "" {
+			fmt.Printf("Error: %s\n", c.Error)
+		}
+		fmt.Println(strings.TrimRight(c.Result, "\n"))
+	}
+	for _, r := range s.Runs {
+		fmt.Printf("\n=== RUN %s ===\n", r.Time.Format(time.RFC3339))
+		if r.Check {
+			fmt.Printf("$ %s  (check)\n", r.Command)
+		} else if r.Command != "" {
+			fmt.Printf("$ %s\n", r.Command)
+		}
+		fmt.Println(strings.TrimRight(r.Output, "\n"))
+		if r.Stderr != "" {
+			fmt.Printf("--- stderr ---\n%s\n", strings.TrimRight(r.Stderr, "\n"))
+		}
+		if status := r.Status(); status != "" {
+			fmt.Printf("Result: %s\n", status)
+		} else if r.Error != "" {
+			fmt.Printf("Error: %s\n", r.Error)
+		}
+		if r.Sandbox != "" {
+			fmt.Printf("Sandbox: %s\n", r.Sandbox)
+		}
+		if r.PTY {
+			fmt.Println("Ran on a terminal; the output above is its transcript.")
+		}
+	}
+	for _, e := range s.Context {
+		fmt.Printf("\n=== CONTEXT (%s) ===\n", e.Kind)
+		if e.Source != "" {
+			fmt.Printf("Source: %s\n", e.Source)
+		}
+		fmt.Println(strings.TrimRight(e.Content, "\n"))
+	}
+}
+
+// handleSessionsGrep prints every matching line as "ID [where]: line", or
+// as grepMatch records in the machine output formats, and reports whether
+// anything matched.
+func handleSessionsGrep(re *regexp.Regexp) bool {
+	sessions, err := listSessions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing sessions: %v\n", err)
+		os.Exit(1)
+	}
+
+	var matches []interface{}
+	match := func(s *Session, where, text string) {
+		for _, line := range strings.Split(text, "\n") {
+			if !re.MatchString(line) {
+				continue
+			}
+			m := grepMatch{SessionID: s.ID, Where: where, Line: strings.TrimSpace(line)}
+			if outputFormat == outputJSONL {
+				printJSON(m)
+			} else if outputFormat == outputText {
+				fmt.Printf("%s [%s]: %s\n", m.SessionID, m.Where, m.Line)
+			}
+			matches = append(matches, m)
+		}
+	}
+	for _, s := range sessions {
+		for _, m := range s.Messages {
+			match(s, m.Role, m.Content)
+		}
+		for _, r := range s.Runs {
+			match(s, "run", r.Command+"\n"+r.Output+"\n"+r.Stderr)
+		}
+		for _, e := range s.Context {
+			match(s, "context", e.Source+"\n"+e.Content)
+		}
+	}
+	if outputFormat == outputJSON {
+		printRecords(matches)
+	}
+	return len(matches) > 0
+}
+
+func handleSessionsPrune(age time.Duration, dryRun bool) {
+	sessions, err := listSessions()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error listing sessions: %v\n", err)
+		os.Exit(1)
+	}
+	cutoff := time.Now().Add(-age)
+	removed := 0
+	for _, s := range sessions {
+		if !s.Created.Before(cutoff) {
+			continue
+		}
+		if dryRun {
+			fmt.Println("Would remove session", s.ID)
+			removed++
+			continue
+		}
+		if err := removeSession(s); err != nil {
+			fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", s.ID, err)
+			continue
+		}
+		removed++
+	}
+	if dryRun {
+		fmt.Printf("%d session(s) older than %s would be removed.\n", removed, formatAge(age))
+	} else {
+		fmt.Printf("Removed %d session(s) older than %s.\n", removed, formatAge(age))
+	}
+}
+
+// parseAge parses a duration that may also use d (days) and w (weeks).
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, errors.New("empty age")
+	}
+	unit := s[len(s)-1]
+	if unit == 'd' || unit == 'w' {
+		n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		day := 24 * time.Hour
+		if unit == 'w' {
+			day *= 7
+		}
+		return time.Duration(n * float64(day)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "<1m"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	case d < 14*24*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	default:
+		return fmt.Sprintf("%dw", int(d.Hours()/(24*7)))
+	}
+}
+
+// firstLine returns the first non-empty line of text, cut to max runes.
+func firstLine(text string, max int) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if r := []rune(line); len(r) > max {
+			return string(r[:max-1]) + "…"
+		}
+		return line
+	}
+	return ""
+}
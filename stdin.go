@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxStdinBytes caps how much piped input is read into memory. The prompt
+// budget trims it much further; this only guards against endless streams.
+const maxStdinBytes = 64 << 20
+
+// stdinIsPiped reports whether stdin is something other than a terminal, so
+// that interactive input has to come from /dev/tty.
+func stdinIsPiped() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice == 0
+}
+
+// stdoutIsPiped reports whether stdout is something other than a terminal.
+func stdoutIsPiped() bool {
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice == 0
+}
+
+// stdinHasInput reports whether ask should read input from stdin: only
+// when it is a pipe or a regular file. Sockets and devices, which editors
+// and services may hand down without ever writing to them, are left alone
+// so that ask doesn't wait for input that never comes.
+func stdinHasInput() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeNamedPipe != 0 || fi.Mode()&os.ModeType == 0
+}
+
+// readPipedStdin returns the data piped into ask, or "" if there is none
+// to read (see stdinHasInput).
+func readPipedStdin() string {
+	if !stdinHasInput() {
+		return ""
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(os.Stdin, maxStdinBytes+1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read stdin: %v\n", err)
+		os.Exit(1)
+	}
+	if len(data) > maxStdinBytes {
+		fmt.Fprintf(os.Stderr, "Warning: only the first %d MiB of stdin were read.\n", maxStdinBytes>>20)
+		data = data[:maxStdinBytes]
+	}
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Read %d bytes from stdin\n", len(data))
+	}
+	return strings.ToValidUTF8(string(data), "")
+}
+
+// stdinContext wraps piped data as a context entry.
+func stdinContext(data string) ContextEntry {
+	return ContextEntry{Kind: "stdin", Source: "stdin", Content: data, Time: time.Now()}
+}
+
+// openTerminal returns the terminal to read interactive input from: stdin
+// itself, or the controlling terminal when stdin is piped. The returned
+// function closes anything that was opened.
+func openTerminal() (*os.File, func(), error) {
+	if !stdinIsPiped() {
+		return os.Stdin, func() {}, nil
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, nil, errors.New("stdin is piped and no terminal is available for input")
+	}
+	return tty, func() { tty.Close() }, nil
+}
+
+// readTerminalLine reads one line of interactive input, such as an answer to
+// a confirmation.
+func readTerminalLine() (string, error) {
+	tty, closeTTY, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer closeTTY()
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/sashabaranov/go-openai"
+)
+
+const (
+	tokenizerCL100K = "cl100k_base"
+	tokenizerO200K  = "o200k_base"
+
+	// Chat formatting overhead per message and for priming the reply, as
+	// documented in OpenAI's token counting guide.
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+
+	// fallbackCharsPerToken is only used if the tokenizer cannot be loaded.
+	fallbackCharsPerToken = 4
+)
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = map[string]*tiktoken.Tiktoken{}
+)
+
+func init() {
+	// Use the BPE ranks embedded in the binary instead of downloading them.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// tokenizerForModel returns the BPE encoding used by a model. Models from
+// other vendors don't publish their tokenizers; the registry maps them to
+// cl100k, which is a close enough approximation for budgeting.
+func tokenizerForModel(m string) string {
+	info, _ := lookupModel(m)
+	if info.Tokenizer == "" {
+		return tokenizerCL100K
+	}
+	return info.Tokenizer
+}
+
+func getTokenizer(name string) (*tiktoken.Tiktoken, error) {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	if tk, ok := tokenizers[name]; ok {
+		return tk, nil
+	}
+	tk, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	tokenizers[name] = tk
+	return tk, nil
+}
+
+// currentTokenizer returns the tokenizer for the selected model, or nil if it
+// could not be loaded.
+func currentTokenizer() *tiktoken.Tiktoken {
+	name := tokenizerForModel(model)
+	tk, err := getTokenizer(name)
+	if err != nil {
+		if debugMode {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Could not load tokenizer %s, estimating instead: %v\n", name, err)
+		}
+		return nil
+	}
+	return tk
+}
+
+// countTokens returns the number of tokens text uses with the current model.
+func countTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	tk := currentTokenizer()
+	if tk == nil {
+		return (len(text) + fallbackCharsPerToken - 1) / fallbackCharsPerToken
+	}
+	return len(tk.EncodeOrdinary(text))
+}
+
+// countMessageTokens estimates the prompt tokens a conversation uses,
+// including the per-message chat formatting.
+func countMessageTokens(messages []openai.ChatCompletionMessage) int {
+	n := tokensPerReply
+	for _, m := range messages {
+		n += tokensPerMessage + countTokens(m.Role) + countTokens(m.Content)
+		for _, call := range m.ToolCalls {
+			n += countTokens(call.Function.Name) + countTokens(call.Function.Arguments)
+		}
+	}
+	return n
+}
+
+// truncateToTokens cuts text to at most max tokens without splitting a
+// UTF-8 sequence. The result is always a prefix of text.
+func truncateToTokens(text string, max int) string {
+	return text[:prefixTokens(text, max)]
+}
+
+// tailTokens keeps the last max tokens of text without splitting a UTF-8
+// sequence. The result is always a suffix of text.
+func tailTokens(text string, max int) string {
+	return text[suffixTokens(text, max):]
+}
+
+// prefixTokens returns the length in bytes of the longest prefix of text
+// that fits in max tokens and ends on a rune boundary.
+func prefixTokens(text string, max int) int {
+	if max <= 0 {
+		return 0
+	}
+	tk := currentTokenizer()
+	if tk == nil {
+		return runeStartBefore(text, max*fallbackCharsPerToken)
+	}
+	tokens := tk.EncodeOrdinary(text)
+	if len(tokens) <= max {
+		return len(text)
+	}
+	// Tokens decode to the exact bytes they were encoded from, but a token
+	// boundary can fall inside a multi-byte rune, and a cut text can
+	// tokenize differently at its end; take fewer tokens until it fits.
+	for k := max; k > 0; k-- {
+		n := runeStartBefore(text, len(tk.Decode(tokens[:k])))
+		if len(tk.EncodeOrdinary(text[:n])) <= max {
+			return n
+		}
+	}
+	return 0
+}
+
+// runeStartBefore moves n back to the start of a rune in text.
+func runeStartBefore(text string, n int) int {
+	if n >= len(text) {
+		return len(text)
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return n
+}
+
+// suffixTokens returns the offset in bytes of the longest suffix of text
+// that fits in max tokens and starts on a rune boundary.
+func suffixTokens(text string, max int) int {
+	if max <= 0 {
+		return len(text)
+	}
+	tk := currentTokenizer()
+	if tk == nil {
+		return runeStartAfter(text, len(text)-max*fallbackCharsPerToken)
+	}
+	tokens := tk.EncodeOrdinary(text)
+	if len(tokens) <= max {
+		return 0
+	}
+	for k := max; k > 0; k-- {
+		start := runeStartAfter(text, len(text)-len(tk.Decode(tokens[len(tokens)-k:])))
+		if len(tk.EncodeOrdinary(text[start:])) <= max {
+			return start
+		}
+	}
+	return len(text)
+}
+
+// runeStartAfter moves start forward to the start of a rune in text.
+func runeStartAfter(text string, start int) int {
+	if start <= 0 {
+		return 0
+	}
+	for start < len(text) && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	return start
+}
+
+// truncateBytes cuts text to at most max bytes on a rune boundary.
+func truncateBytes(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	return text[:max]
+}
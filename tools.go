@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Tool approval policies, set per tool in the config's "tools" section.
+const (
+	toolAllow = "allow" // run without asking
+	toolAsk   = "ask"   // ask the user before each call
+	toolDeny  = "deny"  // never offered to the model
+)
+
+// How a tool call was decided, as recorded in SessionToolCall.Approval.
+const (
+	toolAllowed  = "allowed"  // by policy
+	toolApproved = "approved" // by the user
+	toolDenied   = "denied"
+)
+
+// toolsMode offers local tools to models that support tool calling.
+var toolsMode = true
+
+// toolPrompts is false when nobody can answer an approval prompt, as when
+// ask serves other programs; then only tools allowed by policy are offered.
+var toolPrompts = true
+
+// toolPolicies maps tool names to the policy configured for them; tools
+// not listed keep their default.
+var toolPolicies map[string]string
+
+// toolsAlwaysApproved holds the tools the user approved for the rest of
+// the process by answering "always".
+var toolsAlwaysApproved = map[string]bool{}
+
+// maxToolRounds bounds how many rounds of tool calls one answer may take.
+// After that the model is asked to answer without tools.
+const maxToolRounds = 10
+
+// tool is a function the model may call. Parameters is its JSON schema.
+type tool struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+	// Policy applies unless the config sets one for the tool.
+	Policy string
+	Run    func(ctx context.Context, args json.RawMessage) (string, error)
+}
+
+// availableTools returns every tool ask can offer the model: the built-in
+// ones and those of the configured MCP servers, which are started on first
+// use.
+func availableTools() []tool {
+	tools := append([]tool{}, builtinTools...)
+	return append(tools, startMCPTools()...)
+}
+
+func findTool(name string) (tool, bool) {
+	for _, t := range availableTools() {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return tool{}, false
+}
+
+func validToolPolicy(p string) bool {
+	return p == toolAllow || p == toolAsk || p == toolDeny
+}
+
+func (t tool) policy() string {
+	if p, ok := toolPolicies[t.Name]; ok && validToolPolicy(p) {
+		return p
+	}
+	return t.Policy
+}
+
+// sessionTools returns the tool definitions to send with a request: none if
+// tools are off or the model can't call them, and never denied ones.
+func sessionTools() []openai.Tool {
+	if !toolsMode {
+		return nil
+	}
+	if info, _ := lookupModel(model); !info.Supports(featureTools) {
+		return nil
+	}
+	var defs []openai.Tool
+	for _, t := range availableTools() {
+		if p := t.policy(); p == toolDeny || (p == toolAsk && !toolPrompts) {
+			continue
+		}
+		defs = append(defs, openai.Tool{
+			Type:     openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{Name: t.Name, Description: t.Description, Parameters: t.Parameters},
+		})
+	}
+	return defs
+}
+
+// approveToolCall decides whether a call may run according to the tool's
+// policy, asking the user if needed.
+func approveToolCall(t tool) string {
+	switch t.policy() {
+	case toolAllow:
+		return toolAllowed
+	case toolDeny:
+		return toolDenied
+	}
+	if toolsAlwaysApproved[t.Name] {
+		return toolApproved
+	}
+	if !toolPrompts {
+		fmt.Fprintln(os.Stderr, "Cannot ask for approval, denying the call.")
+		return toolDenied
+	}
+	fmt.Fprintf(os.Stderr, "Allow this call? [y/N/always] ")
+	input, err := readTerminalLine()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nCannot confirm, denying the call: %v\n", err)
+		return toolDenied
+	}
+	switch strings.ToLower(input) {
+	case "always", "a":
+		toolsAlwaysApproved[t.Name] = true
+		return toolApproved
+	case "y", "yes":
+		return toolApproved
+	}
+	return toolDenied
+}
+
+// callTool runs one tool call the model made, after approval, and records
+// it on session. It returns the result to send back to the model; errors
+// are reported to the model rather than ending the answer.
+func callTool(ctx context.Context, session *Session, call openai.ToolCall) string {
+	rec := SessionToolCall{Tool: call.Function.Name, Arguments: call.Function.Arguments, Time: time.Now()}
+	fmt.Fprintf(os.Stderr, "Tool call: %s %s\n", call.Function.Name, call.Function.Arguments)
+
+	t, ok := findTool(call.Function.Name)
+	var result string
+	switch {
+	case !ok:
+		rec.Error = "unknown tool"
+		result = "Error: there is no tool named " + call.Function.Name
+	default:
+		rec.Approval = approveToolCall(t)
+		if rec.Approval == toolDenied {
+			fmt.Fprintln(os.Stderr, "Tool call denied.")
+			result = "The user denied this tool call."
+			break
+		}
+		args := json.RawMessage(call.Function.Arguments)
+		if len(args) == 0 {
+			args = json.RawMessage("{}")
+		}
+		start := time.Now()
+		out, err := t.Run(ctx, args)
+		rec.DurationMS = time.Since(start).Milliseconds()
+		if err != nil {
+			rec.Error = err.Error()
+			fmt.Fprintf(os.Stderr, "Tool error: %v\n", err)
+			result = "Error: " + err.Error()
+			if out != "" {
+				result += "\n" + out
+			}
+		} else {
+			result = out
+		}
+	}
+	if strings.TrimSpace(result) == "" {
+		result = "(no output)"
+	}
+	result = headTail(truncateBytes(result, maxToolOutputBytes), toolResultTokens())
+	rec.Result = result
+	if debugMode {
+		fmt.Fprintf(os.Stderr, "[DEBUG] Tool result (%d tokens):\n%s\n", countTokens(result), result)
+	}
+	session.ToolCalls = append(session.ToolCalls, rec)
+	return result
+}
+
+// toolResultTokens caps a single tool result, so that one large file can't
+// crowd out the conversation.
+func toolResultTokens() int {
+	if n := promptBudget() / 8; n > 0 && n < 8000 {
+		return n
+	}
+	return 8000
+}
+
+// decodeToolArgs unmarshals a tool call's arguments into v.
+func decodeToolArgs(args json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("invalid arguments: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const (
+	// maxToolOutputBytes caps what a tool returns before it is trimmed to
+	// the token limit.
+	maxToolOutputBytes = 256 << 10
+	// maxListedEntries caps a recursive list_dir.
+	maxListedEntries = 1000
+	// maxGrepMatches caps the lines grep returns.
+	maxGrepMatches = 200
+	// maxGrepLineLength shortens matched lines such as minified code.
+	maxGrepLineLength = 300
+)
+
+var builtinTools = []tool{
+	{
+		Name:        "read_file",
+		Description: "Read a text file in the working directory. Optionally only lines start_line to end_line (1-based, inclusive).",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"File path, relative to the working directory"},"start_line":{"type":"integer"},"end_line":{"type":"integer"}},"required":["path"]}`),
+		Policy:      toolAsk,
+		Run:         toolReadFile,
+	},
+	{
+		Name:        "list_dir",
+		Description: "List a directory in the working directory. Directories end with a slash. With recursive, lists the whole tree, skipping files ignored by git.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"Directory path, relative to the working directory (default \".\")"},"recursive":{"type":"boolean"}}}`),
+		Policy:      toolAsk,
+		Run:         toolListDir,
+	},
+	{
+		Name:        "grep",
+		Description: "Search the text files under a path in the working directory for a regular expression (RE2 syntax). Returns matching lines as file:line: text, skipping files ignored by git.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"pattern":{"type":"string"},"path":{"type":"string","description":"File or directory to search (default \".\")"},"ignore_case":{"type":"boolean"}},"required":["pattern"]}`),
+		Policy:      toolAsk,
+		Run:         toolGrep,
+	},
+	{
+		Name:        "run_readonly_command",
+		Description: "Run a shell command that only reads in the working directory, such as ls, cat, find, git log or go list, and return its output and exit code. Commands that could modify anything, paths outside the working directory and $ expansions are rejected.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"command":{"type":"string"}},"required":["command"]}`),
+		Policy:      toolAsk,
+		Run:         toolRunReadOnly,
+	},
+	{
+		Name:        "git_diff",
+		Description: "Show uncommitted changes in the git repository, or with staged the changes staged for commit. Optionally compare against ref and limit to path.",
+		Parameters:  json.RawMessage(`{"type":"object","properties":{"staged":{"type":"boolean"},"ref":{"type":"string","description":"Commit, branch or tag to compare against"},"path":{"type":"string"}}}`),
+		Policy:      toolAsk,
+		Run:         toolGitDiff,
+	},
+}
+
+// toolPath resolves a path given to a tool. Tools only see the working
+// directory, including through symlinks.
+func toolPath(p string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		p = "."
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(cwd, p)
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	root, err := filepath.EvalSymlinks(cwd)
+	if err != nil {
+		return "", err
+	}
+	if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the working directory", p)
+	}
+	return filepath.Clean(p), nil
+}
+
+// relPath shows p relative to the working directory.
+func relPath(p string) string {
+	if rel, err := filepath.Rel(".", p); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(cwd, p); err == nil {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return p
+}
+
+func toolReadFile(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Path      string `json:"path"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	p, err := toolPath(args.Path)
+	if err != nil {
+		return "", err
+	}
+	entry, skip, err := readAttachment(p)
+	if err != nil {
+		return "", err
+	}
+	if skip != "" {
+		return "", fmt.Errorf("%s is %s", args.Path, skip)
+	}
+	if args.StartLine <= 0 && args.EndLine <= 0 {
+		return entry.Content, nil
+	}
+	lines := strings.Split(entry.Content, "\n")
+	start, end := args.StartLine, args.EndLine
+	if start < 1 {
+		start = 1
+	}
+	if end <= 0 || end > len(lines) {
+		end = len(lines)
+	}
+	if start > end {
+		return "", fmt.Errorf("%s has %d lines", args.Path, len(lines))
+	}
+	return strings.Join(lines[start-1:end], "\n"), nil
+}
+
+func toolListDir(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	root, err := toolPath(args.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var entries []string
+	if !args.Recursive {
+		des, err := os.ReadDir(root)
+		if err != nil {
+			return "", err
+		}
+		for _, d := range des {
+			if d.IsDir() {
+				entries = append(entries, d.Name()+"/")
+			} else {
+				entries = append(entries, d.Name())
+			}
+		}
+		return strings.Join(entries, "\n"), nil
+	}
+
+	err = walkToolTree(ctx, root, func(p string, d fs.DirEntry) error {
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			rel += "/"
+		}
+		if len(entries) == maxListedEntries {
+			entries = append(entries, fmt.Sprintf("... (stopped after %d entries)", maxListedEntries))
+			return errToolLimit
+		}
+		entries = append(entries, rel)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errToolLimit) {
+		return "", err
+	}
+	return strings.Join(entries, "\n"), nil
+}
+
+func toolGrep(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Pattern    string `json:"pattern"`
+		Path       string `json:"path"`
+		IgnoreCase bool   `json:"ignore_case"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	pattern := args.Pattern
+	if args.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	root, err := toolPath(args.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	search := func(p string) error {
+		entry, skip, err := readAttachment(p)
+		if err != nil || skip != "" {
+			return nil
+		}
+		scanner := bufio.NewScanner(strings.NewReader(entry.Content))
+		scanner.Buffer(make([]byte, 64*1024), maxAttachmentBytes)
+		for n := 1; scanner.Scan(); n++ {
+			line := scanner.Text()
+			if !re.MatchString(line) {
+				continue
+			}
+			if len(matches) == maxGrepMatches {
+				matches = append(matches, fmt.Sprintf("... (stopped after %d matches)", maxGrepMatches))
+				return errToolLimit
+			}
+			matches = append(matches, fmt.Sprintf("%s:%d: %s", relPath(p), n, truncateBytes(line, maxGrepLineLength)))
+		}
+		return nil
+	}
+
+	if fi, err := os.Stat(root); err == nil && !fi.IsDir() {
+		err = search(root)
+	} else {
+		err = walkToolTree(ctx, root, func(p string, d fs.DirEntry) error {
+			if d.IsDir() {
+				return nil
+			}
+			return search(p)
+		})
+	}
+	if err != nil && !errors.Is(err, errToolLimit) {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "No matches.", nil
+	}
+	return strings.Join(matches, "\n"), nil
+}
+
+var errToolLimit = errors.New("limit reached")
+
+// walkToolTree visits the files and directories under root in lexical
+// order, skipping .git and whatever .gitignore excludes.
+func walkToolTree(ctx context.Context, root string, visit func(p string, d fs.DirEntry) error) error {
+	ignore, err := newGitignore(root)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == root {
+				return err
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p == root {
+			if d.IsDir() {
+				ignore.load(p)
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || ignore.ignored(p, true) {
+				return filepath.SkipDir
+			}
+			ignore.load(p)
+		} else if !d.Type().IsRegular() || ignore.ignored(p, false) {
+			return nil
+		}
+		return visit(p, d)
+	})
+}
+
+func toolGitDiff(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Staged bool   `json:"staged"`
+		Ref    string `json:"ref"`
+		Path   string `json:"path"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	gitArgs := []string{"diff", "--no-ext-diff", "--no-color"}
+	if args.Staged {
+		gitArgs = append(gitArgs, "--cached")
+	}
+	if args.Ref != "" {
+		if strings.HasPrefix(args.Ref, "-") {
+			return "", fmt.Errorf("invalid ref %q", args.Ref)
+		}
+		gitArgs = append(gitArgs, args.Ref)
+	}
+	gitArgs = append(gitArgs, "--")
+	if args.Path != "" {
+		p, err := toolPath(args.Path)
+		if err != nil {
+			return "", err
+		}
+		gitArgs = append(gitArgs, p)
+	}
+	out, err := exec.CommandContext(ctx, "git", gitArgs...).CombinedOutput()
+	if err != nil {
+		return string(out), err
+	}
+	if len(out) == 0 {
+		return "No changes.", nil
+	}
+	return string(out), nil
+}
+
+func toolRunReadOnly(ctx context.Context, raw json.RawMessage) (string, error) {
+	var args struct {
+		Command string `json:"command"`
+	}
+	if err := decodeToolArgs(raw, &args); err != nil {
+		return "", err
+	}
+	command, err := readOnlyCommand(args.Command)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := withTimeout(ctx, commandTimeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command, nil)
+	cmd.Env = readOnlyEnv()
+	out, err := cmd.CombinedOutput()
+	if err = cancelError(ctx, err, commandTimeout); isCancel(err) {
+		return string(out), err
+	}
+	code := -1
+	if cmd.ProcessState != nil {
+		code = cmd.ProcessState.ExitCode()
+	}
+	return fmt.Sprintf("Exit code: %d\n%s", code, out), nil
+}
+
+// readOnlyPrograms are the programs run_readonly_command accepts. Options
+// that make one of them write or run other programs are rejected by
+// readOnlyArgs.
+var readOnlyPrograms = map[string]bool{
+	"ls": true, "cat": true, "head": true, "tail": true, "wc": true, "grep": true, "egrep": true, "fgrep": true,
+	"rg": true, "find": true, "file": true, "stat": true, "du": true, "df": true, "pwd": true, "echo": true,
+	"printf": true, "which": true, "uname": true, "whoami": true, "id": true, "date": true, "printenv": true,
+	"sort": true, "uniq": true, "cut": true, "tr": true, "diff": true, "cmp": true, "basename": true,
+	"dirname": true, "realpath": true, "readlink": true, "tree": true, "ps": true, "jq": true, "true": true,
+	"false": true, "test": true, "[": true, "md5sum": true, "sha1sum": true, "sha256sum": true, "nl": true,
+	"git": true, "go": true,
+}
+
+var readOnlyGitCommands = map[string]bool{
+	"status": true, "log": true, "show": true, "diff": true, "rev-parse": true, "ls-files": true,
+	"ls-tree": true, "blame": true, "describe": true, "shortlog": true, "grep": true, "cat-file": true,
+}
+
+var readOnlyGoCommands = map[string]bool{"version": true, "list": true, "doc": true, "env": true}
+
+// readOnlyGitFlags turn off the external diff and textconv drivers, which
+// run programs named in git's configuration, for the git commands that
+// would use them.
+var readOnlyGitFlags = map[string][]string{
+	"diff": {"--no-ext-diff", "--no-textconv"}, "log": {"--no-ext-diff", "--no-textconv"},
+	"show": {"--no-ext-diff", "--no-textconv"}, "blame": {"--no-ext-diff", "--no-textconv"},
+	"grep": {"--no-textconv"},
+}
+
+// readOnlyCommand parses cmd and accepts it only if every program it runs is
+// known to only read, no redirection writes anywhere but /dev/null, and no
+// argument names a path outside the working directory. It returns the
+// command to run, which is cmd with readOnlyGitFlags added.
+func readOnlyCommand(cmd string) (string, error) {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(cmd), "")
+	if err != nil {
+		return "", fmt.Errorf("cannot parse the command: %v", err)
+	}
+	var problem error
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if problem != nil {
+			return false
+		}
+		switch n := node.(type) {
+		case *syntax.Stmt:
+			for _, r := range n.Redirs {
+				if target, ok := redirectTarget(r); ok && target != "/dev/null" {
+					problem = fmt.Errorf("the command writes to %s", target)
+				} else if r.Word != nil && !ok && r.Op == syntax.RdrIn {
+					problem = readOnlyWord(r.Word)
+				}
+				if problem != nil {
+					break
+				}
+			}
+		case *syntax.CallExpr:
+			// An assignment such as GIT_EXTERNAL_DIFF=... can make a
+			// read-only program run another one.
+			if len(n.Assigns) > 0 {
+				problem = errors.New("variable assignments are not allowed")
+				break
+			}
+			args := callArgs(n.Args)
+			if problem = readOnlyArgs(args); problem != nil {
+				break
+			}
+			for _, w := range n.Args[1:] {
+				if problem = readOnlyWord(w); problem != nil {
+					break
+				}
+			}
+			if args[0] == "git" {
+				var flags []*syntax.Word
+				for _, f := range readOnlyGitFlags[args[1]] {
+					flags = append(flags, &syntax.Word{Parts: []syntax.WordPart{&syntax.Lit{Value: f}}})
+				}
+				n.Args = append(n.Args[:2], append(flags, n.Args[2:]...)...)
+			}
+		case *syntax.DeclClause, *syntax.LetClause, *syntax.ArithmCmd:
+			problem = errors.New("variable assignments are not allowed")
+		case *syntax.FuncDecl:
+			problem = errors.New("function definitions are not allowed")
+		}
+		return true
+	})
+	if problem != nil {
+		return "", problem
+	}
+	var buf bytes.Buffer
+	if err := syntax.NewPrinter().Print(&buf, file); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// readOnlyWord checks an argument of a read-only command: it must not
+// expand variables or commands, which could name anything, and a path must
+// not lead outside the working directory.
+func readOnlyWord(w *syntax.Word) error {
+	if expandsWord(w.Parts) {
+		return fmt.Errorf("%s expands variables or commands; use literal arguments", nodeString(w))
+	}
+	arg := wordString(w)
+	if strings.HasPrefix(arg, "-") {
+		// Only an option's value, as in --file=path, can be a path.
+		i := strings.Index(arg, "=")
+		if i < 0 {
+			return nil
+		}
+		arg = arg[i+1:]
+	}
+	return readablePath(arg)
+}
+
+func expandsWord(parts []syntax.WordPart) bool {
+	for _, part := range parts {
+		switch p := part.(type) {
+		case *syntax.ParamExp, *syntax.CmdSubst, *syntax.ArithmExp, *syntax.ProcSubst:
+			return true
+		case *syntax.DblQuoted:
+			if expandsWord(p.Parts) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readablePath rejects p if it names something outside the working
+// directory, by how it is written or, for the files it names or matches as
+// a glob, by where their symlinks lead.
+func readablePath(p string) error {
+	if p == "" {
+		return nil
+	}
+	outside := fmt.Errorf("%s is outside the working directory", p)
+	if strings.HasPrefix(p, "~") {
+		return outside
+	}
+	if filepath.IsAbs(p) {
+		return outside
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(p), "/") {
+		if elem == ".." {
+			return outside
+		}
+	}
+	// A symlink may still lead elsewhere, whether named or matched by a glob.
+	matches, _ := filepath.Glob(p)
+	if _, err := os.Lstat(p); err == nil {
+		matches = append(matches, p)
+	}
+	for _, m := range matches {
+		if _, err := toolPath(m); err != nil {
+			return fmt.Errorf("%s leads outside the working directory", m)
+		}
+	}
+	return nil
+}
+
+// readOnlyEnv is the environment of run_readonly_command: ask's own, minus
+// variables that look like they hold credentials, such as the API keys, and
+// those that can make git or the dynamic linker run other code.
+func readOnlyEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name := strings.ToUpper(strings.SplitN(kv, "=", 2)[0])
+		drop := false
+		for _, word := range secretEnvWords {
+			if strings.Contains(name, word) {
+				drop = true
+				break
+			}
+		}
+		for _, prefix := range codeEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+var secretEnvWords = []string{"KEY", "TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "AUTH", "COOKIE", "SESSION"}
+
+var codeEnvPrefixes = []string{"GIT_", "LD_", "DYLD_"}
+
+// readOnlyArgs checks one program invocation.
+func readOnlyArgs(args []string) error {
+	prog := args[0]
+	if !readOnlyPrograms[prog] {
+		return fmt.Errorf("%s is not on the list of read-only programs", prog)
+	}
+	sub := ""
+	if len(args) > 1 {
+		sub = args[1]
+	}
+	for _, a := range args[1:] {
+		bad := false
+		switch prog {
+		case "find":
+			bad = a == "-delete" || strings.HasPrefix(a, "-exec") || strings.HasPrefix(a, "-ok") || strings.HasPrefix(a, "-fprint") || a == "-fls"
+		case "sort":
+			bad = shortOption(a, 'o') || longOption(a, "--output") || longOption(a, "--compress-program")
+		case "tree":
+			bad = shortOption(a, 'o')
+		case "rg":
+			bad = strings.HasPrefix(a, "--pre")
+		case "date":
+			bad = a == "-s" || strings.HasPrefix(a, "--set")
+		case "git":
+			bad = longOption(a, "--output") || longOption(a, "--ext-diff") || longOption(a, "--textconv", "--text") ||
+				longOption(a, "--open-files-in-pager") || (sub == "grep" && shortOption(a, 'O'))
+		case "go":
+			// go's flags may start with one dash or two.
+			name := strings.SplitN("-"+strings.TrimLeft(a, "-"), "=", 2)[0]
+			bad = name == "-w" || name == "-u" || name == "-toolexec" || name == "-exec"
+		}
+		if bad {
+			return fmt.Errorf("%s %s may modify files or run other programs", prog, a)
+		}
+	}
+	switch {
+	case prog == "git" && !readOnlyGitCommands[sub]:
+		return fmt.Errorf("git %s is not a read-only git command (allowed: %s)", sub, strings.Join(sortedKeys(readOnlyGitCommands), ", "))
+	case prog == "go" && !readOnlyGoCommands[sub]:
+		return fmt.Errorf("go %s is not a read-only go command (allowed: %s)", sub, strings.Join(sortedKeys(readOnlyGoCommands), ", "))
+	}
+	return nil
+}
+
+// shortOption reports whether a is a group of single-letter options, such
+// as -no, that includes c.
+func shortOption(a string, c byte) bool {
+	return len(a) > 1 && a[0] == '-' && a[1] != '-' && strings.IndexByte(a[1:], c) >= 0
+}
+
+// longOption reports whether a is the long option name, with or without a
+// value, or an abbreviation of it, which getopt and git both accept. exact
+// lists other options that name starts with, which are not abbreviations.
+func longOption(a, name string, exact ...string) bool {
+	opt := strings.SplitN(a, "=", 2)[0]
+	if len(opt) <= 2 || !strings.HasPrefix(opt, "--") || !strings.HasPrefix(name, opt) {
+		return false
+	}
+	for _, e := range exact {
+		if opt == e {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
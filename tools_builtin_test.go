@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadOnlyCommand(t *testing.T) {
+	tests := []struct {
+		cmd string
+		ok  bool
+	}{
+		{"ls -la", true},
+		{"cat main.go | grep -n func | head -5", true},
+		{"git status", true},
+		{"git log --oneline -5", true},
+		{"git grep -n hello", true},
+		{"git diff --text", true},
+		{"go list ./...", true},
+		{"sort -n -k2 go.mod", true},
+		{"find . -name '*.go'", true},
+		{"ls > /dev/null 2>&1", true},
+
+		// Assignments can point git, the linker or the shell at other programs.
+		{"GIT_CONFIG_COUNT=1 GIT_CONFIG_KEY_0=core.fsmonitor GIT_CONFIG_VALUE_0='touch pwned1' git status", false},
+		{"GIT_EXTERNAL_DIFF=./x git diff", false},
+		{"LD_PRELOAD=./x.so ls", false},
+		{"x=1", false},
+		{"export GIT_EXTERNAL_DIFF=./x; git diff", false},
+		{"declare -x GIT_PAGER=./x", false},
+		{"let x=1", false},
+		{"((x=1))", false},
+
+		// Options that run other programs.
+		{`git grep --no-index -O"touch pwned2" hello`, false},
+		{"git grep -O hello", false},
+		{"git grep -inOless hello", false},
+		{"git grep --open-files-in-pager=less hello", false},
+		{"git grep --open=less hello", false},
+		{"git diff --ext-diff", false},
+		{"git diff --ext", false},
+		{"git log --textconv", false},
+		{"git show --textc", false},
+		{"git log --output=x", false},
+		{"git -c core.pager=x log", false},
+		{"go list -toolexec ./x ./...", false},
+		{"go list -toolexec=./x ./...", false},
+		{"go list --toolexec=./x ./...", false},
+		{"go list -exec ./x", false},
+		{"go env -w GOFLAGS=x", false},
+		{"sort --compress-program=./x go.mod", false},
+		{"sort --compress=./x go.mod", false},
+		{"sort -o x go.mod", false},
+		{"sort -no x go.mod", false},
+		{"sort --out=x go.mod", false},
+		{"tree -ao x", false},
+		{"find . -exec rm {} ;", false},
+		{"find . -delete", false},
+		{"rg --pre ./x hello", false},
+
+		// Programs, redirections and paths.
+		{"rm -rf x", false},
+		{"sh -c ls", false},
+		{"ls > x", false},
+		{"ls >& x", false},
+		{"ls >> x", false},
+		{"cat < /etc/passwd", false},
+		{"cat /etc/passwd", false},
+		{"cat ../x", false},
+		{"cat ~/.ssh/id_rsa", false},
+		{"cat $HOME/x", false},
+		{"cat $(echo x)", false},
+		{"ls --directory=/etc", false},
+		{"f() { ls; }", false},
+		{"echo $(rm x)", false},
+	}
+	for _, tt := range tests {
+		_, err := readOnlyCommand(tt.cmd)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("readOnlyCommand(%q) = %v, want ok %v", tt.cmd, err, tt.ok)
+		}
+	}
+}
+
+func TestReadOnlyCommandGitFlags(t *testing.T) {
+	tests := map[string]string{
+		"git diff HEAD -- x":     "git diff --no-ext-diff --no-textconv HEAD -- x",
+		"git log -p | head":      "git log --no-ext-diff --no-textconv -p | head",
+		"git grep -n hello":      "git grep --no-textconv -n hello",
+		"git status && git show": "git status && git show --no-ext-diff --no-textconv",
+		"ls":                     "ls",
+	}
+	for cmd, want := range tests {
+		got, err := readOnlyCommand(cmd)
+		if err != nil {
+			t.Errorf("readOnlyCommand(%q): %v", cmd, err)
+			continue
+		}
+		if got = strings.TrimSpace(got); got != want {
+			t.Errorf("readOnlyCommand(%q) = %q, want %q", cmd, got, want)
+		}
+	}
+}
+
+func TestReadOnlyEnv(t *testing.T) {
+	dropped := []string{"OPENAI_API_KEY", "GITHUB_TOKEN", "GIT_CONFIG_COUNT", "GIT_EXTERNAL_DIFF", "LD_PRELOAD", "DYLD_INSERT_LIBRARIES"}
+	for _, name := range dropped {
+		t.Setenv(name, "x")
+	}
+	t.Setenv("ASK_TEST_KEPT", "x")
+
+	env := map[string]bool{}
+	for _, kv := range readOnlyEnv() {
+		env[strings.SplitN(kv, "=", 2)[0]] = true
+	}
+	for _, name := range dropped {
+		if env[name] {
+			t.Errorf("%s was passed to the command", name)
+		}
+	}
+	if !env["ASK_TEST_KEPT"] {
+		t.Error("ASK_TEST_KEPT was not passed to the command")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// defaultUntilAttempts is how many answers "ask until" asks for before it
+// gives up, unless -attempts says otherwise.
+const defaultUntilAttempts = 5
+
+// untilTask is the first turn of "ask until": the task, the check that
+// decides when it is done and how the answer should look.
+func untilTask(task, verify, status string) string {
+	return fmt.Sprintf("%s\n\nThe task is done when the check `%s` exits with status 0. It currently fails (%s); its output is attached below. Reply with the commands to run next in a single code block. They will be run, then the check runs again and you will see the results.", task, verify, status)
+}
+
+// untilRequest is the turn sent after the check failed again; the runs
+// themselves are included by budgetRefinement.
+func untilRequest(verify string, check SessionRun) string {
+	return fmt.Sprintf("The check `%s` still fails (%s). Reply with the next commands to run in a single code block.", verify, check.Status())
+}
+
+// handleUntil asks the model for commands that make verify pass, runs them
+// after confirmation, runs verify and feeds its result back, until verify
+// exits 0 or attempts answers or tokenBudget tokens (if not zero) are used
+// up. Each answer is stored as a refinement of the one before.
+func handleUntil(verify, task string, attempts, tokenBudget int, attach []string) {
+	entries, err := collectAttachments(attach)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error attaching files: %v\n", err)
+		os.Exit(1)
+	}
+
+	check := runCheck(verify)
+	if check.ExitCode != nil && *check.ExitCode == 0 {
+		fmt.Fprintln(os.Stderr, "The check already passes; nothing to do.")
+		return
+	}
+	if check.Error == errInterrupted.Error() {
+		os.Exit(1)
+	}
+
+	checkEntry := ContextEntry{Kind: "command", Source: verify, Content: check.Output + check.Stderr, Time: check.Time}
+	entries = append([]ContextEntry{checkEntry}, entries...)
+	prompt, kept, report := budgetTurn(nil, untilTask(task, verify, check.Status()), contextItems(entries), askLayout)
+	report.Print(os.Stderr)
+	markTrimmed(entries, kept)
+
+	session := newSession([]openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: prompt}}, nil)
+	session.ContextTrimmed = report.Trimmed()
+	for _, e := range entries {
+		e.Included = true
+		session.Context = append(session.Context, e)
+	}
+
+	used := 0
+	for attempt := 1; ; attempt++ {
+		fmt.Fprintf(os.Stderr, "--- Attempt %d of %d ---\n", attempt, attempts)
+		answer, err := answerSession(session, os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error getting response: %v\n", err)
+			os.Exit(1)
+		}
+		if err := createSession(session); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not store session: %v\n", err)
+		}
+		used += answerTokens(session)
+		if session.Interrupted {
+			fmt.Fprintf(os.Stderr, "Partial session stored in: %s\n", session.Dir())
+			os.Exit(1)
+		}
+
+		if cmdStr := extractCommand(answer); cmdStr == "" {
+			fmt.Fprintln(os.Stderr, "No runnable command found in the answer.")
+		} else {
+			ran := len(session.Runs)
+			err := runCommandInteractively(cmdStr, session)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error running command: %v\n", err)
+			}
+			if len(session.Runs) == ran {
+				fmt.Fprintf(os.Stderr, "Stopped. Continue with: ask refine -session %s\n", session.ID)
+				os.Exit(1)
+			}
+			if session.Runs[len(session.Runs)-1].Error == errInterrupted.Error() {
+				os.Exit(1)
+			}
+		}
+
+		check = runCheck(verify)
+		session.Runs = append(session.Runs, check)
+		if err := saveSession(session); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Could not store the check's output: %v\n", err)
+		}
+		if check.ExitCode != nil && *check.ExitCode == 0 {
+			fmt.Fprintf(os.Stderr, "The check passes after %d attempt(s), %d tokens.\nSession stored in: %s\n", attempt, used, session.Dir())
+			return
+		}
+		if check.Error == errInterrupted.Error() {
+			os.Exit(1)
+		}
+		if attempt >= attempts {
+			fmt.Fprintf(os.Stderr, "Giving up: the check still fails after %d attempt(s).\nSession stored in: %s\n", attempt, session.Dir())
+			os.Exit(1)
+		}
+		if tokenBudget > 0 && used >= tokenBudget {
+			fmt.Fprintf(os.Stderr, "Giving up: %d tokens used (budget %d) and the check still fails.\nSession stored in: %s\n", used, tokenBudget, session.Dir())
+			os.Exit(1)
+		}
+
+		turn, trimmed := budgetRefinement(session, untilRequest(verify, check), nil)
+		if debugMode {
+			fmt.Fprintf(os.Stderr, "[DEBUG] Next turn:\n%s\n", turn)
+		}
+		session = newSession(appendMessage(session.Messages, openai.ChatMessageRoleUser, turn), session)
+		session.ContextTrimmed = trimmed
+	}
+}
+
+// runCheck runs the verify command of "ask until" in the working directory,
+// showing its output live. It is not confirmed, since the user gave it.
+func runCheck(verify string) SessionRun {
+	fmt.Fprintf(os.Stderr, "Checking: %s\n", verify)
+	ctx, stop := interruptContext()
+	defer stop()
+	ctx, cancel := withTimeout(ctx, commandTimeout)
+	defer cancel()
+	start := time.Now()
+	res, err := runCommand(shellCommand(ctx, verify, nil))
+	err = cancelError(ctx, err, commandTimeout)
+	run := newSessionRun(verify, start, res, err)
+	run.Check = true
+	if status := run.Status(); status != "" {
+		fmt.Fprintf(os.Stderr, "Check: %s\n", status)
+	} else if run.Error != "" {
+		fmt.Fprintf(os.Stderr, "Check: %s\n", run.Error)
+	}
+	return run
+}
+
+// answerTokens is what the last answer of s cost: the usage the provider
+// reported, or an estimate of the conversation when it reported none.
+func answerTokens(s *Session) int {
+	if s.Usage.TotalTokens > 0 {
+		return s.Usage.TotalTokens
+	}
+	return countMessageTokens(s.Messages)
+}